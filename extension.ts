@@ -13,6 +13,7 @@ interface AskRequest {
   requestId: string;
   reason: string;
   callbackPort?: number;  // MCP 服务器的回调端口
+  token?: string;         // MCP 服务器的回调令牌，回调时通过 X-Ask-Continue-Token 头原样返回
 }
 
 let server: http.Server | null = null;
@@ -207,7 +208,8 @@ async function sendResponseToMCP(
   requestId: string,
   userInput: string,
   cancelled: boolean,
-  callbackPort?: number
+  callbackPort?: number,
+  token?: string
 ): Promise<void> {
   const port = callbackPort || MCP_CALLBACK_PORT;
   return new Promise((resolve, reject) => {
@@ -226,6 +228,7 @@ async function sendResponseToMCP(
         headers: {
           "Content-Type": "application/json",
           "Content-Length": Buffer.byteLength(postData),
+          ...(token ? { "X-Ask-Continue-Token": token } : {}),
         },
         timeout: 5000,
       },
@@ -274,7 +277,7 @@ async function showAskContinueDialog(request: AskRequest): Promise<void> {
     console.error("[Ask Continue] Failed to create webview panel:", err);
     lastPendingRequest = null;
     try {
-      await sendResponseToMCP(request.requestId, "", true, request.callbackPort);
+      await sendResponseToMCP(request.requestId, "", true, request.callbackPort, request.token);
     } catch {
       // 忽略发送错误
     }
@@ -313,7 +316,7 @@ async function showAskContinueDialog(request: AskRequest): Promise<void> {
               finalText = finalText + '\n\n' + filesData;
             }
             
-            await sendResponseToMCP(request.requestId, finalText, false, request.callbackPort);
+            await sendResponseToMCP(request.requestId, finalText, false, request.callbackPort, request.token);
             panel.dispose();
           } catch (error) {
             responseSent = false;
@@ -325,7 +328,7 @@ async function showAskContinueDialog(request: AskRequest): Promise<void> {
         case "end":
           try {
             responseSent = true;
-            await sendResponseToMCP(request.requestId, "", false, request.callbackPort);
+            await sendResponseToMCP(request.requestId, "", false, request.callbackPort, request.token);
             panel.dispose();
           } catch (error) {
             responseSent = false;
@@ -337,7 +340,7 @@ async function showAskContinueDialog(request: AskRequest): Promise<void> {
         case "cancel":
           try {
             responseSent = true;
-            await sendResponseToMCP(request.requestId, "", true, request.callbackPort);
+            await sendResponseToMCP(request.requestId, "", true, request.callbackPort, request.token);
             panel.dispose();
           } catch (error) {
             // Ignore errors on cancel
@@ -378,7 +381,7 @@ async function showAskContinueDialog(request: AskRequest): Promise<void> {
     }
     if (responseSent) return;
     try {
-      await sendResponseToMCP(request.requestId, "", true, request.callbackPort);
+      await sendResponseToMCP(request.requestId, "", true, request.callbackPort, request.token);
     } catch {
       // Ignore errors on dispose
     }
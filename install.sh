@@ -99,7 +99,7 @@ if [ "$USE_GO" = true ]; then
     cd "$SCRIPT_DIR/mcp-server-go"
     if [ ! -f "ask-continue-mcp" ]; then
         echo -e "${BLUE}[编译]${NC} 正在编译 Go 版本..."
-        $GO_CMD build -o ask-continue-mcp server.go
+        $GO_CMD build -o ask-continue-mcp .
     fi
     echo -e "${GREEN}[OK]${NC} Go 版本已就绪"
 fi
@@ -0,0 +1,117 @@
+// ============================================================
+// 异步 ask_continue：立即返回句柄，结果通过 get_continuation 获取
+// 支持异步工具调用的客户端不必让单次调用一直挂起等待用户
+// ============================================================
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+const AsyncResultTTL = time.Hour // 已完成但一直没有取走的结果保留时长
+
+// asyncContinuation 一次异步询问的状态
+type asyncContinuation struct {
+	startedAt  time.Time
+	finishedAt time.Time
+	result     *mcp.CallToolResult // 为 nil 表示仍在等待用户回复
+}
+
+// AsyncStatus 返回给 AI 的句柄/状态（JSON）
+// 句柄就是请求 ID，与 list_pending、/cancel 使用的 ID 相同
+type AsyncStatus struct {
+	Status      string  `json:"status"` // pending
+	RequestID   string  `json:"requestId"`
+	WaitSeconds float64 `json:"waitSeconds"`
+	Next        string  `json:"next"`
+}
+
+var (
+	asyncContinuations = make(map[string]*asyncContinuation)
+	asyncMutex         sync.Mutex
+)
+
+// startAsyncContinuation 在后台发送提示并等待，立即返回 pending 句柄
+func startAsyncContinuation(ctx context.Context, args askContinueArgs) *mcp.CallToolResult {
+	args.requestID = reserveRequestID()
+	entry := &asyncContinuation{startedAt: time.Now()}
+
+	asyncMutex.Lock()
+	pruneAsyncContinuationsLocked()
+	asyncContinuations[args.requestID] = entry
+	asyncMutex.Unlock()
+
+	// 本次工具调用马上返回，等待不能随调用的 ctx 一起取消；会话信息仍需保留
+	waitCtx := context.WithoutCancel(ctx)
+	go func() {
+		result := waitAskContinue(waitCtx, args)
+		asyncMutex.Lock()
+		entry.result = result
+		entry.finishedAt = time.Now()
+		asyncMutex.Unlock()
+		infof("异步请求 %s 已有结果，等待 get_continuation 获取", args.requestID)
+	}()
+
+	infof("异步请求 %s 已创建", args.requestID)
+	return asyncStatusResult(args.requestID, entry)
+}
+
+// pruneAsyncContinuationsLocked 清理长时间没有取走的结果（调用方需持有 asyncMutex）
+func pruneAsyncContinuationsLocked() {
+	for id, entry := range asyncContinuations {
+		if entry.result != nil && time.Since(entry.finishedAt) > AsyncResultTTL {
+			delete(asyncContinuations, id)
+		}
+	}
+}
+
+func asyncStatusResult(requestID string, entry *asyncContinuation) *mcp.CallToolResult {
+	data, _ := json.Marshal(AsyncStatus{
+		Status:      "pending",
+		RequestID:   requestID,
+		WaitSeconds: time.Since(entry.startedAt).Seconds(),
+		Next:        fmt.Sprintf("用户尚未回复，稍后调用 get_continuation(requestId=%q) 获取结果", requestID),
+	})
+	return mcp.NewToolResultText(string(data))
+}
+
+// ============================================================
+// get_continuation：获取异步 ask_continue 的结果
+// ============================================================
+func newGetContinuationTool() mcp.Tool {
+	return mcp.NewTool("get_continuation",
+		mcp.WithDescription(fmt.Sprintf("获取以 async=true 调用 %s 的结果。用户尚未回复时返回 pending 状态，请稍后再试；已回复时返回与同步调用相同的结果（每个结果只能取一次）。", toolName)),
+		mcp.WithString("requestId",
+			mcp.Required(),
+			mcp.Description("异步调用返回的 requestId"),
+		),
+	)
+}
+
+func getContinuationHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	requestID := strings.TrimSpace(argString(request, "requestId"))
+	if requestID == "" {
+		return mcp.NewToolResultError("缺少参数 requestId"), nil
+	}
+
+	asyncMutex.Lock()
+	defer asyncMutex.Unlock()
+
+	entry, ok := asyncContinuations[requestID]
+	if !ok {
+		return mcp.NewToolResultError(fmt.Sprintf("未知的 requestId: %s（可能已经取过结果或已过期）", requestID)), nil
+	}
+	if entry.result == nil {
+		return asyncStatusResult(requestID, entry), nil
+	}
+
+	delete(asyncContinuations, requestID)
+	return entry.result, nil
+}
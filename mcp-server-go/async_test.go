@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 异步提问立即返回句柄；用户回复前轮询得到 pending，回复后取到结果且只能取一次
+func TestAsyncAskAndPoll(t *testing.T) {
+	startTestServer(t)
+	resetPendingState(t)
+	override(t, &asyncContinuations, make(map[string]*asyncContinuation))
+	logs := captureLog(t, levelInfo)
+	ext := newFakeExtension(t, nil)
+
+	var handle AsyncStatus
+	text := resultText(callTool(t, askContinueHandler, map[string]any{"reason": "部署吗？", "async": true}))
+	if err := json.Unmarshal([]byte(text), &handle); err != nil || handle.Status != "pending" || handle.RequestID == "" {
+		t.Fatalf("异步调用应返回 pending 句柄: %s", text)
+	}
+
+	req := ext.next(t)
+	if req.RequestID != handle.RequestID {
+		t.Fatalf("扩展收到的请求 ID = %s, want %s", req.RequestID, handle.RequestID)
+	}
+	poll := func() string {
+		return resultText(callTool(t, getContinuationHandler, map[string]any{"requestId": handle.RequestID}))
+	}
+	if got := poll(); !strings.Contains(got, `"status":"pending"`) {
+		t.Fatalf("用户回复前应返回 pending: %s", got)
+	}
+
+	postJSON(fmt.Sprintf("http://127.0.0.1:%d/response", req.CallbackPort), req.Token,
+		CallbackResponse{RequestID: req.RequestID, UserInput: "部署到预发环境"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	got := poll()
+	for strings.Contains(got, `"status":"pending"`) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got = poll()
+	}
+	if !strings.Contains(got, "部署到预发环境") {
+		t.Fatalf("结果中没有用户回复: %s", got)
+	}
+
+	again := callTool(t, getContinuationHandler, map[string]any{"requestId": handle.RequestID})
+	if !again.IsError {
+		t.Errorf("结果取走后再次获取应报错: %s", resultText(again))
+	}
+	// 后台等待的 goroutine 在结果写入后才记日志，等它结束再恢复日志配置
+	waitFor(t, "后台等待结束", func() bool { return strings.Contains(logs.String(), "已有结果") })
+}
+
+func TestGetContinuationRejectsBadHandle(t *testing.T) {
+	override(t, &asyncContinuations, make(map[string]*asyncContinuation))
+	tests := []struct {
+		name string
+		args map[string]any
+		want string
+	}{
+		{"missing", map[string]any{}, "requestId"},
+		{"unknown", map[string]any{"requestId": "req_404"}, "req_404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := callTool(t, getContinuationHandler, tt.args)
+			if !result.IsError || !strings.Contains(resultText(result), tt.want) {
+				t.Errorf("结果 = %q, want error containing %q", resultText(result), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+// ============================================================
+// 运行时配置（通过环境变量覆盖默认值）
+// ============================================================
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// 配置项
+// ============================================================
+const (
+	DefaultPortFileTTL      = 24 * time.Hour  // 端口文件默认有效期
+	DefaultPendingHeartbeat = 5 * time.Minute // 等待中请求的心跳日志默认间隔
+	DefaultDiscoveryTimeout = 2 * time.Second // 扫描端口文件目录的默认时限
+	DefaultMaxCallbackBytes = 24 << 20        // 回调请求体默认上限，足够容纳 3 张图片（base64）和长文本
+
+	DefaultToolName = "ask_continue" // 默认工具名
+)
+
+var (
+	maxRetryCount            = MaxRetryCount           // 最大重试次数（ASK_CONTINUE_MAX_RETRIES）
+	retryInterval            = RetryInterval           // 重试基础间隔秒数（ASK_CONTINUE_RETRY_INTERVAL）
+	retryMaxInterval         = RetryMaxInterval        // 退避间隔上限秒数（ASK_CONTINUE_RETRY_MAX_INTERVAL）
+	resultTemplate           string                    // 自定义结果文本模板，为空时使用当前语言的默认模板（ASK_CONTINUE_RESULT_TEMPLATE）
+	suppressReminder         bool                      // 默认模板去掉强制提醒（ASK_CONTINUE_SUPPRESS_REMINDER）
+	resultPrefixFlag         bool                      // 结果首行加 CONTINUE: true/false（ASK_CONTINUE_RESULT_PREFIX_FLAG）
+	resultFormat             = "text"                  // 结果格式 text / json（ASK_CONTINUE_RESULT_FORMAT）
+	loopLimit                = DefaultLoopLimit        // 循环检测阈值，0 表示关闭（ASK_CONTINUE_LOOP_LIMIT）
+	promptSlots              chan struct{}             // 同时显示的提示数量限制，nil 表示不限（ASK_CONTINUE_MAX_VISIBLE_PROMPTS / ASK_CONTINUE_SERIAL_PROMPTS）
+	portFileTTL              = DefaultPortFileTTL      // 端口文件有效期，0 表示不清理（ASK_CONTINUE_PORT_TTL）
+	reasonTemplate           string                    // 原因改写模板，如 "{reason}，是否继续？"（ASK_CONTINUE_REASON_TEMPLATE）
+	reasonCommand            string                    // 原因改写命令，从 stdin 读入原因（ASK_CONTINUE_REASON_COMMAND）
+	pendingHeartbeat         = DefaultPendingHeartbeat // 等待中请求的心跳日志间隔，0 表示关闭（ASK_CONTINUE_PENDING_HEARTBEAT）
+	statusInterval           time.Duration             // 状态摘要日志的间隔，0 表示关闭（ASK_CONTINUE_STATUS_INTERVAL）
+	idleTimeout              time.Duration             // 无工具调用、无回调且没有等待中的请求超过该时长后退出，0 表示关闭（ASK_CONTINUE_IDLE_TIMEOUT）
+	extCertPin               []byte                    // 扩展证书 SHA-256 指纹，设置后通过 HTTPS 连接扩展（ASK_CONTINUE_EXT_CERT_PIN）
+	cancelAsDefault          bool                      // 用户取消时按默认指令继续而不是结束（ASK_CONTINUE_CANCEL_AS_DEFAULT）
+	cancelDefaultInstruction string                    // 取消视为继续时返回的指令，为空时使用当前语言的默认指令（ASK_CONTINUE_CANCEL_INSTRUCTION）
+	debugEndpoints           bool                      // 在回调服务器上启用 /debug/dump 诊断接口（ASK_CONTINUE_DEBUG）
+	toolLang                 = "zh"                    // 工具说明和返回文本的语言 zh / en（ASK_CONTINUE_LANG）
+	toolName                 = DefaultToolName         // 工具名，多个实例并存时用于区分（ASK_CONTINUE_TOOL_NAME）
+	persistPending           bool                      // 持久化待处理请求，重启后重新发送给扩展（ASK_CONTINUE_PERSIST_PENDING）
+	historyMax               = DefaultHistoryMax       // 内存中保留的问答条数上限，0 表示不保留（ASK_CONTINUE_HISTORY_MAX）
+	probeLimiter             *tokenBucket              // 出站探测限速器，nil 表示不限速（ASK_CONTINUE_PROBE_RATE）
+	discoveryTimeout         = DefaultDiscoveryTimeout // 扫描端口文件目录的时限，0 表示不限（ASK_CONTINUE_DISCOVERY_TIMEOUT）
+	callbackPortStart        = CallbackPortStart       // 回调端口起始值（ASK_CONTINUE_CALLBACK_PORT_START / -callback-port-start）
+	currentLogLevel          = levelInfo               // 日志级别（ASK_CONTINUE_LOG_LEVEL / -log-level）
+	reasonPrecedence         = "file"                  // reason 与 reason_file 同时提供时的处理 file / inline / concat（ASK_CONTINUE_REASON_PRECEDENCE）
+	detectPatch              = true                    // 识别用户输入的 diff / patch 并放入结果的 patch 字段（ASK_CONTINUE_DETECT_PATCH）
+	defaultSilent            bool                      // 未指定 silent 参数时默认静默提示（ASK_CONTINUE_DEFAULT_SILENT）
+	serverWorkspace          string                    // 本服务器所服务的项目目录，未设置时为当前工作目录（ASK_CONTINUE_WORKSPACE）
+	maxCallbackBytes         = DefaultMaxCallbackBytes // 回调接口（/response、/cancel、/cancel-all）请求体上限字节数，超出返回 413（ASK_CONTINUE_MAX_CALLBACK_BYTES）
+	allowLegacyCallbacks     bool                      // 接受不带令牌的回调，兼容尚未发送 X-Ask-Continue-Token 的旧版扩展（ASK_CONTINUE_ALLOW_LEGACY_CALLBACKS）
+	mcpTransport             = "stdio"                 // MCP 传输方式 stdio / sse（ASK_CONTINUE_TRANSPORT）
+	sseAddr                  = DefaultSSEAddr          // sse 模式的监听地址（ASK_CONTINUE_SSE_ADDR）
+	secretScan               = "off"                   // 提示文本中疑似密钥的处理 off / redact / reject（ASK_CONTINUE_SECRET_SCAN）
+	secretEntropy            = DefaultSecretEntropy    // 高熵片段判定为密钥的阈值，越低越敏感（ASK_CONTINUE_SECRET_ENTROPY）
+)
+
+// ============================================================
+// 加载配置（在 init 中调用，日志已可用）
+// ============================================================
+func loadConfig() {
+	maxRetryCount = envInt("ASK_CONTINUE_MAX_RETRIES", MaxRetryCount, 1)
+	retryInterval = envInt("ASK_CONTINUE_RETRY_INTERVAL", RetryInterval, 0)
+	retryMaxInterval = envInt("ASK_CONTINUE_RETRY_MAX_INTERVAL", RetryMaxInterval, 0)
+	callbackPortStart = envInt("ASK_CONTINUE_CALLBACK_PORT_START", CallbackPortStart, 1)
+	if raw := os.Getenv("ASK_CONTINUE_LOG_LEVEL"); raw != "" {
+		if level, err := parseLogLevel(raw); err != nil {
+			warnf("ASK_CONTINUE_LOG_LEVEL 无效，使用 info: %v", err)
+		} else {
+			currentLogLevel = level
+		}
+	}
+
+	if tmpl := os.Getenv("ASK_CONTINUE_RESULT_TEMPLATE"); tmpl != "" {
+		if err := validateResultTemplate(tmpl); err != nil {
+			warnf("ASK_CONTINUE_RESULT_TEMPLATE 无效，使用默认模板: %v", err)
+		} else {
+			resultTemplate = tmpl
+			infof("使用自定义结果模板")
+		}
+	}
+
+	// 自定义模板优先；未自定义时可以去掉默认模板末尾的强制提醒
+	suppressReminder = envBool("ASK_CONTINUE_SUPPRESS_REMINDER", false)
+	if suppressReminder && resultTemplate == "" {
+		infof("已关闭结果中的强制提醒")
+	}
+
+	resultPrefixFlag = envBool("ASK_CONTINUE_RESULT_PREFIX_FLAG", false)
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv("ASK_CONTINUE_RESULT_FORMAT"))); format {
+	case "", "text":
+	case "json":
+		resultFormat = format
+	default:
+		warnf("ASK_CONTINUE_RESULT_FORMAT=%q 无效，使用 text", format)
+	}
+	loopLimit = envInt("ASK_CONTINUE_LOOP_LIMIT", DefaultLoopLimit, 0)
+	detectPatch = envBool("ASK_CONTINUE_DETECT_PATCH", true)
+	defaultSilent = envBool("ASK_CONTINUE_DEFAULT_SILENT", false)
+	if workspace := strings.TrimSpace(os.Getenv("ASK_CONTINUE_WORKSPACE")); workspace != "" {
+		serverWorkspace = workspace
+	} else if cwd, err := os.Getwd(); err == nil {
+		serverWorkspace = cwd
+	}
+
+	if tmpl := os.Getenv("ASK_CONTINUE_REASON_TEMPLATE"); tmpl != "" {
+		if strings.Contains(tmpl, "{reason}") {
+			reasonTemplate = tmpl
+		} else {
+			warnf("ASK_CONTINUE_REASON_TEMPLATE 缺少 {reason} 占位符，已忽略")
+		}
+	}
+	reasonCommand = os.Getenv("ASK_CONTINUE_REASON_COMMAND")
+	switch precedence := strings.ToLower(strings.TrimSpace(os.Getenv("ASK_CONTINUE_REASON_PRECEDENCE"))); precedence {
+	case "":
+	case "file", "inline", "concat":
+		reasonPrecedence = precedence
+	default:
+		warnf("ASK_CONTINUE_REASON_PRECEDENCE=%q 无效，使用 file", precedence)
+	}
+	switch transport := strings.ToLower(strings.TrimSpace(os.Getenv("ASK_CONTINUE_TRANSPORT"))); transport {
+	case "":
+	case "stdio", "sse":
+		mcpTransport = transport
+	default:
+		warnf("ASK_CONTINUE_TRANSPORT=%q 无效，使用 stdio", transport)
+	}
+	if addr := strings.TrimSpace(os.Getenv("ASK_CONTINUE_SSE_ADDR")); addr != "" {
+		sseAddr = addr
+	}
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("ASK_CONTINUE_SECRET_SCAN"))); mode {
+	case "":
+	case "off", "redact", "reject":
+		secretScan = mode
+	default:
+		warnf("ASK_CONTINUE_SECRET_SCAN=%q 无效，使用 off", mode)
+	}
+	if raw := strings.TrimSpace(os.Getenv("ASK_CONTINUE_SECRET_ENTROPY")); raw != "" {
+		if value, err := strconv.ParseFloat(raw, 64); err == nil && value > 0 {
+			secretEntropy = value
+		} else {
+			warnf("环境变量 ASK_CONTINUE_SECRET_ENTROPY=%q 无效，使用默认值 %g", raw, DefaultSecretEntropy)
+		}
+	}
+	portFileTTL = envDuration("ASK_CONTINUE_PORT_TTL", DefaultPortFileTTL)
+	pendingHeartbeat = envDuration("ASK_CONTINUE_PENDING_HEARTBEAT", DefaultPendingHeartbeat)
+	statusInterval = envDuration("ASK_CONTINUE_STATUS_INTERVAL", 0)
+	idleTimeout = envDuration("ASK_CONTINUE_IDLE_TIMEOUT", 0)
+	discoveryTimeout = envDuration("ASK_CONTINUE_DISCOVERY_TIMEOUT", DefaultDiscoveryTimeout)
+
+	if raw := os.Getenv("ASK_CONTINUE_EXT_CERT_PIN"); raw != "" {
+		pin, err := parseCertPin(raw)
+		if err != nil {
+			// 安全相关配置无效时不能静默退回明文连接
+			fatalf("ASK_CONTINUE_EXT_CERT_PIN 无效: %v", err)
+		}
+		extCertPin = pin
+		pinExtensionCert(pin)
+		infof("已启用扩展证书固定，通过 HTTPS 连接扩展")
+	}
+
+	cancelAsDefault = envBool("ASK_CONTINUE_CANCEL_AS_DEFAULT", false)
+	if instruction := strings.TrimSpace(os.Getenv("ASK_CONTINUE_CANCEL_INSTRUCTION")); instruction != "" {
+		cancelDefaultInstruction = instruction
+	}
+
+	debugEndpoints = envBool("ASK_CONTINUE_DEBUG", false)
+	persistPending = envBool("ASK_CONTINUE_PERSIST_PENDING", false)
+	// ASK_CONTINUE_HISTORY_SIZE 是旧名称，未设置新变量时仍然生效
+	historyMax = envInt("ASK_CONTINUE_HISTORY_MAX", envInt("ASK_CONTINUE_HISTORY_SIZE", DefaultHistoryMax, 0), 0)
+	maxCallbackBytes = envInt("ASK_CONTINUE_MAX_CALLBACK_BYTES", DefaultMaxCallbackBytes, 1)
+	allowLegacyCallbacks = envBool("ASK_CONTINUE_ALLOW_LEGACY_CALLBACKS", false)
+	if allowLegacyCallbacks {
+		warnf("已允许不带令牌的回调（ASK_CONTINUE_ALLOW_LEGACY_CALLBACKS），本机其他进程可能伪造用户输入，升级扩展后请关闭")
+	}
+	probeLimiter = nil
+	if rate := envInt("ASK_CONTINUE_PROBE_RATE", DefaultProbeRate, 0); rate > 0 {
+		probeLimiter = newTokenBucket(rate)
+	}
+
+	if name := strings.TrimSpace(os.Getenv("ASK_CONTINUE_TOOL_NAME")); name != "" {
+		if toolNamePattern.MatchString(name) {
+			toolName = name
+			infof("工具名: %s", toolName)
+		} else {
+			warnf("ASK_CONTINUE_TOOL_NAME=%q 不是合法的标识符（字母开头，仅含字母、数字、_、-，最多 64 字符），使用默认值 %s", name, DefaultToolName)
+		}
+	}
+
+	if lang := strings.ToLower(strings.TrimSpace(os.Getenv("ASK_CONTINUE_LANG"))); lang != "" {
+		if _, ok := askContinueDocsByLang[lang]; ok {
+			toolLang = lang
+		} else {
+			warnf("ASK_CONTINUE_LANG=%q 不支持，使用 %s", lang, fallbackLang)
+			toolLang = fallbackLang
+		}
+	}
+
+	// 串行模式等同于最多显示 1 个提示；两者都设置时以 ASK_CONTINUE_MAX_VISIBLE_PROMPTS 为准
+	serialDefault := 0
+	if envBool("ASK_CONTINUE_SERIAL_PROMPTS", false) {
+		serialDefault = 1
+	}
+	promptSlots = nil
+	if limit := envInt("ASK_CONTINUE_MAX_VISIBLE_PROMPTS", serialDefault, 0); limit > 0 {
+		promptSlots = make(chan struct{}, limit)
+		infof("同一时间最多显示 %d 个提示，其余排队等待", limit)
+	}
+}
+
+// ============================================================
+// 命令行参数（优先级：命令行 > 环境变量 > 默认值）
+// 在 loadConfig 之后解析，参数默认值就是环境变量解析后的结果
+// ============================================================
+
+// parseFlags 解析命令行参数，返回是否只需打印版本号
+func parseFlags(args []string) (showVersion bool, err error) {
+	fs := flag.NewFlagSet("ask-continue-mcp", flag.ContinueOnError)
+	fs.BoolVar(&showVersion, "version", false, "打印版本号后退出")
+	fs.BoolVar(&showVersion, "v", false, "同 -version")
+	portStart := fs.Int("callback-port-start", callbackPortStart, "回调端口起始值")
+	retries := fs.Int("max-retries", maxRetryCount, "连接扩展的最大重试次数")
+	interval := fs.Int("retry-interval", retryInterval, "重试基础间隔（秒）")
+	levelName := fs.String("log-level", currentLogLevel.String(), "日志级别 debug / info / warn / error")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+
+	switch {
+	case *portStart < 1 || *portStart > 65535:
+		return false, fmt.Errorf("-callback-port-start 超出范围: %d", *portStart)
+	case *retries < 1:
+		return false, fmt.Errorf("-max-retries 至少为 1: %d", *retries)
+	case *interval < 0:
+		return false, fmt.Errorf("-retry-interval 不能为负数: %d", *interval)
+	}
+	level, err := parseLogLevel(*levelName)
+	if err != nil {
+		return false, err
+	}
+
+	callbackPortStart = *portStart
+	maxRetryCount = *retries
+	retryInterval = *interval
+	currentLogLevel = level
+	return showVersion, nil
+}
+
+// logResolvedConfig 启动时打印最终生效的主要配置，便于确认命令行/环境变量是否生效
+func logResolvedConfig() {
+	infof("生效配置: 传输方式 %s，回调端口起始 %d，最多重试 %d 次，基础间隔 %d 秒，上限 %d 秒，日志级别 %s",
+		mcpTransport, callbackPortStart, maxRetryCount, retryInterval, retryMaxInterval, currentLogLevel)
+	infof("端口文件目录: %s", portFileDir)
+}
+
+// toolNamePattern 合法的工具名
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,63}$`)
+
+// ============================================================
+// 环境变量解析辅助函数
+// ============================================================
+
+// envBool 读取布尔环境变量（1/true/yes/on 为真，0/false/no/off 为假）
+func envBool(name string, def bool) bool {
+	raw := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	switch raw {
+	case "":
+		return def
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	}
+	warnf("环境变量 %s=%q 无效，使用默认值 %v", name, raw, def)
+	return def
+}
+
+// envDuration 读取时长环境变量，支持 "24h"、"90m" 等格式，纯数字按秒计算
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+		return d
+	}
+	warnf("环境变量 %s=%q 无效，使用默认值 %v", name, raw, def)
+	return def
+}
+
+// envInt 读取整数环境变量，未设置、无法解析或小于 min 时返回默认值
+func envInt(name string, def, min int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min {
+		warnf("环境变量 %s=%q 无效，使用默认值 %d", name, raw, def)
+		return def
+	}
+	return value
+}
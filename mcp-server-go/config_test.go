@@ -0,0 +1,422 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig 设置环境变量后重新加载配置，测试结束时还原全部配置项
+// loadConfig 只覆盖设置了的环境变量对应的配置，因此逐个保存而不是重新加载
+func loadTestConfig(t *testing.T, env map[string]string) {
+	t.Helper()
+	override(t, &maxRetryCount, maxRetryCount)
+	override(t, &retryInterval, retryInterval)
+	override(t, &retryMaxInterval, retryMaxInterval)
+	override(t, &resultTemplate, resultTemplate)
+	override(t, &suppressReminder, suppressReminder)
+	override(t, &resultPrefixFlag, resultPrefixFlag)
+	override(t, &resultFormat, resultFormat)
+	override(t, &loopLimit, loopLimit)
+	override(t, &promptSlots, promptSlots)
+	override(t, &portFileTTL, portFileTTL)
+	override(t, &reasonTemplate, reasonTemplate)
+	override(t, &reasonCommand, reasonCommand)
+	override(t, &pendingHeartbeat, pendingHeartbeat)
+	override(t, &statusInterval, statusInterval)
+	override(t, &idleTimeout, idleTimeout)
+	override(t, &extCertPin, extCertPin)
+	override(t, &cancelAsDefault, cancelAsDefault)
+	override(t, &cancelDefaultInstruction, cancelDefaultInstruction)
+	override(t, &debugEndpoints, debugEndpoints)
+	override(t, &toolLang, toolLang)
+	override(t, &toolName, toolName)
+	override(t, &persistPending, persistPending)
+	override(t, &historyMax, historyMax)
+	override(t, &probeLimiter, probeLimiter)
+	override(t, &discoveryTimeout, discoveryTimeout)
+	override(t, &callbackPortStart, callbackPortStart)
+	override(t, &currentLogLevel, currentLogLevel)
+	override(t, &reasonPrecedence, reasonPrecedence)
+	override(t, &detectPatch, detectPatch)
+	override(t, &defaultSilent, defaultSilent)
+	override(t, &serverWorkspace, serverWorkspace)
+	override(t, &maxCallbackBytes, maxCallbackBytes)
+	override(t, &allowLegacyCallbacks, allowLegacyCallbacks)
+	override(t, &mcpTransport, mcpTransport)
+	override(t, &sseAddr, sseAddr)
+	override(t, &secretScan, secretScan)
+	override(t, &secretEntropy, secretEntropy)
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	loadConfig()
+}
+
+// ============================================================
+// 结果文本模板
+// ============================================================
+
+func TestResultTemplateEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{"valid", "→ {userInput} ({reason})", "→ {userInput} ({reason})"},
+		{"missing userInput", "{reason}", ""},
+		{"unknown placeholder", "{userInput} {foo}", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_RESULT_TEMPLATE": tt.tmpl})
+			if resultTemplate != tt.want {
+				t.Errorf("resultTemplate = %q, want %q", resultTemplate, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderResultTemplate(t *testing.T) {
+	tests := []struct {
+		name         string
+		tmpl         string
+		userInput    string
+		plan, window string
+		want         string
+	}{
+		{"all placeholders", "{userInput}|{reason}|{plan}{window}", "go", "P\n", "W", "go|why|P\nW"},
+		{"placeholders in user input are not expanded", "{userInput}", "see {reason}", "", "", "see {reason}"},
+		{"trailing blank lines trimmed", "{userInput}\n\n{plan}{window}", "go", "", "", "go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderResultTemplate(tt.tmpl, tt.userInput, "why", tt.plan, tt.window); got != tt.want {
+				t.Errorf("renderResultTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 提示显示数量
+// ============================================================
+
+func TestSerialPromptsEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int // promptSlots 容量，0 表示不限
+	}{
+		{"", 0},
+		{"1", 1},
+		{"true", 1},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_SERIAL_PROMPTS": tt.value})
+			if got := cap(promptSlots); got != tt.want {
+				t.Errorf("cap(promptSlots) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 重试
+// ============================================================
+
+func TestRetryEnv(t *testing.T) {
+	tests := []struct {
+		name                          string
+		env                           map[string]string
+		retries, interval, maxBackoff int
+	}{
+		{"defaults", nil, MaxRetryCount, RetryInterval, RetryMaxInterval},
+		{"custom", map[string]string{
+			"ASK_CONTINUE_MAX_RETRIES":        "3",
+			"ASK_CONTINUE_RETRY_INTERVAL":     "0",
+			"ASK_CONTINUE_RETRY_MAX_INTERVAL": "10",
+		}, 3, 0, 10},
+		{"invalid falls back", map[string]string{
+			"ASK_CONTINUE_MAX_RETRIES":        "0",
+			"ASK_CONTINUE_RETRY_INTERVAL":     "-1",
+			"ASK_CONTINUE_RETRY_MAX_INTERVAL": "soon",
+		}, MaxRetryCount, RetryInterval, RetryMaxInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, tt.env)
+			if maxRetryCount != tt.retries || retryInterval != tt.interval || retryMaxInterval != tt.maxBackoff {
+				t.Errorf("重试配置 = %d/%d/%d, want %d/%d/%d",
+					maxRetryCount, retryInterval, retryMaxInterval, tt.retries, tt.interval, tt.maxBackoff)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 原因改写
+// ============================================================
+
+func TestReasonTemplateEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"{reason}？", "{reason}？"},
+		{"是否继续？", ""}, // 缺少占位符，忽略
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_REASON_TEMPLATE": tt.value})
+			if reasonTemplate != tt.want {
+				t.Errorf("reasonTemplate = %q, want %q", reasonTemplate, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultPrefixFlagEnv(t *testing.T) {
+	for value, want := range map[string]bool{"": false, "1": true, "on": true, "off": false, "maybe": false} {
+		t.Run(value, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_RESULT_PREFIX_FLAG": value})
+			if resultPrefixFlag != want {
+				t.Errorf("resultPrefixFlag = %v, want %v", resultPrefixFlag, want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 出站探测限速
+// ============================================================
+
+func TestProbeRateEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64 // 每秒速率，0 表示不限速
+	}{
+		{"", DefaultProbeRate},
+		{"5", 5},
+		{"0", 0},
+		{"-3", DefaultProbeRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_PROBE_RATE": tt.value})
+			var got float64
+			if probeLimiter != nil {
+				got = probeLimiter.rate
+			}
+			if got != tt.want {
+				t.Errorf("probe rate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 问答历史
+// ============================================================
+
+// ASK_CONTINUE_HISTORY_MAX 优先，未设置时沿用旧的 ASK_CONTINUE_HISTORY_SIZE
+func TestHistoryMaxEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		max, size string
+		want      int
+	}{
+		{"default", "", "", DefaultHistoryMax},
+		{"max", "20", "", 20},
+		{"legacy size", "", "5", 5},
+		{"max wins", "20", "5", 20},
+		{"disabled", "0", "", 0},
+		{"invalid", "-1", "", DefaultHistoryMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_HISTORY_MAX": tt.max, "ASK_CONTINUE_HISTORY_SIZE": tt.size})
+			if historyMax != tt.want {
+				t.Errorf("historyMax = %d, want %d", historyMax, tt.want)
+			}
+		})
+	}
+}
+
+func TestReasonPrecedenceEnv(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"", "file"},
+		{"inline", "inline"},
+		{" CONCAT ", "concat"},
+		{"both", "file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			override(t, &reasonPrecedence, "file")
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_REASON_PRECEDENCE": tt.value})
+			if reasonPrecedence != tt.want {
+				t.Errorf("reasonPrecedence = %q, want %q", reasonPrecedence, tt.want)
+			}
+		})
+	}
+}
+
+// ASK_CONTINUE_MAX_VISIBLE_PROMPTS 优先；只设置 SERIAL_PROMPTS 时等同于最多 1 个
+func TestMaxVisiblePromptsEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		max, serial string
+		want        int // promptSlots 容量，0 表示不限
+	}{
+		{"unset", "", "", 0},
+		{"max", "3", "", 3},
+		{"serial only", "", "1", 1},
+		{"max wins over serial", "4", "1", 4},
+		{"zero keeps unlimited", "0", "", 0},
+		{"zero overrides serial", "0", "1", 0},
+		{"invalid falls back to serial", "-2", "1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_MAX_VISIBLE_PROMPTS": tt.max, "ASK_CONTINUE_SERIAL_PROMPTS": tt.serial})
+			if got := cap(promptSlots); got != tt.want {
+				t.Errorf("cap(promptSlots) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusIntervalEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"10m", 10 * time.Minute},
+		{"30", 30 * time.Second},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_STATUS_INTERVAL": tt.value})
+			if statusInterval != tt.want {
+				t.Errorf("statusInterval = %v, want %v", statusInterval, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 工具说明语言
+// ============================================================
+
+func TestToolLangEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"", "zh"},
+		{" EN ", "en"},
+		{"zh", "zh"},
+		{"fr", fallbackLang},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			override(t, &toolLang, "zh")
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_LANG": tt.env})
+			if toolLang != tt.want {
+				t.Errorf("toolLang = %q, want %q", toolLang, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantErr     string
+		wantVersion bool
+		wantPort    int
+		wantRetries int
+		wantLevel   logLevel
+	}{
+		{"defaults", nil, "", false, 23983, 5, levelInfo},
+		{"overrides", []string{"-callback-port-start", "30000", "-max-retries", "2", "-log-level", "WARNING"}, "", false, 30000, 2, levelWarn},
+		{"version", []string{"-v"}, "", true, 23983, 5, levelInfo},
+		{"port out of range", []string{"-callback-port-start", "70000"}, "超出范围", false, 23983, 5, levelInfo},
+		{"no retries", []string{"-max-retries", "0"}, "至少为 1", false, 23983, 5, levelInfo},
+		{"bad log level", []string{"-log-level", "loud"}, "未知的日志级别", false, 23983, 5, levelInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &callbackPortStart, 23983)
+			override(t, &maxRetryCount, 5)
+			override(t, &retryInterval, retryInterval)
+			override(t, &currentLogLevel, levelInfo)
+
+			showVersion, err := parseFlags(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseFlags() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("parseFlags() error = %v", err)
+			}
+			if showVersion != tt.wantVersion || callbackPortStart != tt.wantPort || maxRetryCount != tt.wantRetries || currentLogLevel != tt.wantLevel {
+				t.Errorf("version, port, retries, level = %v, %d, %d, %s, want %v, %d, %d, %s",
+					showVersion, callbackPortStart, maxRetryCount, currentLogLevel, tt.wantVersion, tt.wantPort, tt.wantRetries, tt.wantLevel)
+			}
+		})
+	}
+}
+
+// 读取环境变量时产生的日志暂存到参数解析之后，按 -log-level 过滤
+func TestStartupLogsFollowFlagLevel(t *testing.T) {
+	logs := captureLog(t, levelInfo)
+	override(t, &bufferingStartupLogs, true)
+	override(t, &maxRetryCount, maxRetryCount)
+	loadTestConfig(t, map[string]string{"ASK_CONTINUE_RESULT_TEMPLATE": "{userInput}", "ASK_CONTINUE_MAX_RETRIES": "many"})
+	if logs.String() != "" {
+		t.Fatalf("参数解析前不应输出日志:\n%s", logs.String())
+	}
+
+	if _, err := parseFlags([]string{"-log-level", "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	flushStartupLogs()
+	got := logs.String()
+	if strings.Contains(got, "使用自定义结果模板") {
+		t.Errorf("-log-level warn 时不应输出 info 日志:\n%s", got)
+	}
+	if !strings.Contains(got, "ASK_CONTINUE_MAX_RETRIES") {
+		t.Errorf("警告应在参数解析后输出:\n%s", got)
+	}
+}
+
+func TestSecretScanEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		scan, entropy string
+		wantScan      string
+		wantEntropy   float64
+	}{
+		{"defaults", "", "", "off", DefaultSecretEntropy},
+		{"redact", "Redact", "", "redact", DefaultSecretEntropy},
+		{"reject with entropy", "reject", "3.5", "reject", 3.5},
+		{"invalid values", "block", "-1", "off", DefaultSecretEntropy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &secretScan, "off")
+			override(t, &secretEntropy, DefaultSecretEntropy)
+			loadTestConfig(t, map[string]string{"ASK_CONTINUE_SECRET_SCAN": tt.scan, "ASK_CONTINUE_SECRET_ENTROPY": tt.entropy})
+			if secretScan != tt.wantScan || secretEntropy != tt.wantEntropy {
+				t.Errorf("secretScan, secretEntropy = %q, %v, want %q, %v", secretScan, secretEntropy, tt.wantScan, tt.wantEntropy)
+			}
+		})
+	}
+}
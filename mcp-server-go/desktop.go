@@ -0,0 +1,55 @@
+// ============================================================
+// 系统桌面通知（urgency=high 时使用）
+// Windsurf 窗口不在前台时，扩展的提示容易被忽略，由服务器额外弹一条系统通知
+// 尽力而为：失败只记录日志，不影响工具调用
+// ============================================================
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+const DesktopNotifyTimeout = 10 * time.Second // 通知命令的最长执行时间
+
+// windowsToastScript 通过托盘气泡显示通知；标题和正文从环境变量读取，避免拼接命令带来的转义问题
+const windowsToastScript = `Add-Type -AssemblyName System.Windows.Forms, System.Drawing
+$n = New-Object System.Windows.Forms.NotifyIcon
+$n.Icon = [System.Drawing.SystemIcons]::Information
+$n.Visible = $true
+$n.ShowBalloonTip(10000, $env:ASK_CONTINUE_NOTIFY_TITLE, $env:ASK_CONTINUE_NOTIFY_MESSAGE, 'Warning')
+Start-Sleep -Seconds 6
+$n.Dispose()`
+
+// sendDesktopNotification 在后台发送系统通知
+func sendDesktopNotification(title, message string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DesktopNotifyTimeout)
+		defer cancel()
+
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			// 参数通过 argv 传入，不拼进 AppleScript 源码
+			cmd = exec.CommandContext(ctx, "osascript",
+				"-e", "on run argv",
+				"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+				"-e", "end run",
+				title, message)
+		case "windows":
+			cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToastScript)
+			cmd.Env = append(os.Environ(),
+				"ASK_CONTINUE_NOTIFY_TITLE="+title,
+				"ASK_CONTINUE_NOTIFY_MESSAGE="+message)
+		default:
+			cmd = exec.CommandContext(ctx, "notify-send", "--urgency=critical", "--", title, message)
+		}
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			warnf("发送系统通知失败: %v %s", err, output)
+		}
+	}()
+}
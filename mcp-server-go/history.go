@@ -0,0 +1,73 @@
+// ============================================================
+// 问答历史：保留最近的问题与回答，供模型回看
+// 敏感输入（ask_secret 等 Masked 请求）不会进入历史
+// ============================================================
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultHistoryMax = 100 // 默认在内存中保留的问答条数上限
+
+// HistoryEntry 一次已完成的问答
+type HistoryEntry struct {
+	RequestID  string
+	Type       string
+	Category   string
+	Reason     string
+	UserInput  string
+	Cancelled  bool
+	AskedAt    time.Time
+	AnsweredAt time.Time
+}
+
+var (
+	historyMutex sync.Mutex
+	history      []HistoryEntry // 按完成时间从旧到新排列，长度不超过 historyMax
+)
+
+// recordHistory 记录一次已完成的问答，超出容量时丢弃最旧的条目
+func recordHistory(req ExtensionRequest, userInput string, cancelled bool, askedAt time.Time) {
+	if req.Masked || historyMax == 0 {
+		return
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	history = append(history, HistoryEntry{
+		RequestID:  req.RequestID,
+		Type:       req.Type,
+		Category:   req.Category,
+		Reason:     req.Reason,
+		UserInput:  userInput,
+		Cancelled:  cancelled,
+		AskedAt:    askedAt,
+		AnsweredAt: time.Now(),
+	})
+	if overflow := len(history) - historyMax; overflow > 0 {
+		history = append(history[:0:0], history[overflow:]...)
+	}
+}
+
+// recentHistory 返回最近的 count 条问答，最新的在前
+func recentHistory(count int) []HistoryEntry {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	count = min(count, len(history))
+	entries := make([]HistoryEntry, 0, count)
+	for i := len(history) - 1; i >= len(history)-count; i-- {
+		entries = append(entries, history[i])
+	}
+	return entries
+}
+
+// historyCount 当前保留的问答条数
+func historyCount() int {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	return len(history)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHistoryCapEvictsOldest(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		recorded int
+		want     []string // recentHistory 返回的 ID，最新的在前
+	}{
+		{"under cap", 5, 2, []string{"req_2", "req_1"}},
+		{"evicts oldest", 3, 5, []string{"req_5", "req_4", "req_3"}},
+		{"disabled", 0, 3, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &history, nil)
+			override(t, &historyMax, tt.max)
+			for i := 1; i <= tt.recorded; i++ {
+				recordHistory(ExtensionRequest{RequestID: fmt.Sprintf("req_%d", i), Type: "ask_continue"}, "ok", false, time.Now())
+			}
+
+			got := []string{}
+			for _, entry := range recentHistory(10) {
+				got = append(got, entry.RequestID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recentHistory() = %v, want %v", got, tt.want)
+			}
+			if n := historyCount(); n != len(tt.want) {
+				t.Errorf("historyCount() = %d, want %d", n, len(tt.want))
+			}
+		})
+	}
+}
+
+// 敏感输入不进入历史
+func TestHistorySkipsMaskedInput(t *testing.T) {
+	override(t, &history, nil)
+	override(t, &historyMax, 10)
+	recordHistory(ExtensionRequest{RequestID: "req_secret", Type: "ask_secret", Masked: true}, "hunter2", false, time.Now())
+	if n := historyCount(); n != 0 {
+		t.Errorf("敏感输入被记录到历史中（%d 条）", n)
+	}
+}
+
+func TestHealthReportsHistoryCount(t *testing.T) {
+	base := startTestServer(t)
+	override(t, &history, nil)
+	override(t, &historyMax, 2)
+	for i := range 3 {
+		recordHistory(ExtensionRequest{RequestID: fmt.Sprintf("req_%d", i)}, "ok", false, time.Now())
+	}
+
+	resp, err := http.Get(base + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var health struct {
+		History int `json:"history"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health.History != 2 {
+		t.Errorf("/health history = %d, want 2", health.History)
+	}
+}
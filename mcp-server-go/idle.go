@@ -0,0 +1,116 @@
+// ============================================================
+// 空闲退出（ASK_CONTINUE_IDLE_TIMEOUT）
+// 部分环境下 Windsurf 关闭后服务器进程仍然残留；长时间没有工具调用和回调、
+// 也没有执行中的工具调用和等待中的请求时主动退出，避免残留进程越积越多
+// ============================================================
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+var (
+	idleNow      = time.Now   // 空闲计时使用的时钟，测试中替换为假时钟
+	lastActivity atomic.Int64 // 最近一次工具调用或回调的时间（UnixNano）
+
+	inFlightMutex sync.Mutex
+	inFlightCalls = make(map[string]int) // 执行中的工具调用，按 JSON-RPC id 计数
+)
+
+// touchActivity 记录一次活动，重置空闲计时
+func touchActivity() {
+	lastActivity.Store(idleNow().UnixNano())
+}
+
+// beginToolCallHook 工具调用开始：重置空闲计时并计入执行中（注册为 BeforeCallTool 钩子）
+func beginToolCallHook(ctx context.Context, id any, message *mcp.CallToolRequest) {
+	touchActivity()
+	inFlightMutex.Lock()
+	inFlightCalls[fmt.Sprint(id)]++
+	inFlightMutex.Unlock()
+}
+
+// endToolCallHook 工具调用正常结束（注册为 AfterCallTool 钩子）
+func endToolCallHook(ctx context.Context, id any, message *mcp.CallToolRequest, result *mcp.CallToolResult) {
+	finishToolCall(id)
+}
+
+// toolCallErrorHook 工具调用出错结束（注册为 OnError 钩子，其他方法的错误忽略）
+func toolCallErrorHook(ctx context.Context, id any, method mcp.MCPMethod, message any, err error) {
+	if method == mcp.MethodToolsCall {
+		finishToolCall(id)
+	}
+}
+
+// finishToolCall 从执行中移除；请求解析失败时 OnError 也会触发而 BeforeCallTool 没有，
+// 所以只移除登记过的 id，计数不会变成负数
+func finishToolCall(id any) {
+	touchActivity()
+	key := fmt.Sprint(id)
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+	switch n := inFlightCalls[key]; {
+	case n > 1:
+		inFlightCalls[key] = n - 1
+	case n == 1:
+		delete(inFlightCalls, key)
+	}
+}
+
+// inFlightToolCalls 执行中的工具调用数
+func inFlightToolCalls() int {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+	total := 0
+	for _, n := range inFlightCalls {
+		total += n
+	}
+	return total
+}
+
+// idleExpired 判断是否可以空闲退出，返回已空闲的时长。
+// 从持久化文件恢复的请求不计入：原调用已随旧进程结束，没有人在等它们的结果
+func idleExpired(timeout time.Duration) (time.Duration, bool) {
+	idle := idleNow().Sub(time.Unix(0, lastActivity.Load()))
+	if idle < timeout || inFlightToolCalls() > 0 {
+		return idle, false
+	}
+	pendingMutex.RLock()
+	defer pendingMutex.RUnlock()
+	for _, pending := range pendingRequests {
+		if !pending.restored {
+			return idle, false
+		}
+	}
+	return idle, true
+}
+
+// startIdleWatchdog 空闲超过 timeout 且没有执行中的调用和等待中的请求时优雅关闭并退出进程
+func startIdleWatchdog(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	touchActivity()
+	interval := max(min(timeout/4, time.Minute), time.Second)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			idle, expired := idleExpired(timeout)
+			if !expired {
+				continue
+			}
+			infof("已空闲 %s（ASK_CONTINUE_IDLE_TIMEOUT=%s），正在退出...", idle.Round(time.Second), timeout)
+			shutdownCallbackServer()
+			shutdownMCPTransport()
+			os.Exit(0)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// useFakeIdleClock 用可手动推进的假时钟替换空闲计时，并清空执行中的调用
+func useFakeIdleClock(t *testing.T) func(time.Duration) {
+	t.Helper()
+	now := time.Unix(1_700_000_000, 0)
+	override(t, &idleNow, func() time.Time { return now })
+	override(t, &inFlightCalls, make(map[string]int))
+	old := lastActivity.Load()
+	t.Cleanup(func() { lastActivity.Store(old) })
+	touchActivity()
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestIdleExpired(t *testing.T) {
+	const timeout = time.Hour
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		inFlight int
+		pending  map[string]*PendingRequest
+		want     bool
+	}{
+		{"recent activity", 59 * time.Minute, 0, nil, false},
+		{"idle", timeout, 0, nil, true},
+		{"tool call in flight", 3 * timeout, 1, nil, false},
+		{"waiting for user", 3 * timeout, 0, map[string]*PendingRequest{"req_1": {}}, false},
+		{"only restored requests", 3 * timeout, 0, map[string]*PendingRequest{"req_1": {restored: true}}, true},
+		{"restored and live", 3 * timeout, 0, map[string]*PendingRequest{
+			"req_1": {restored: true},
+			"req_2": {},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			advance := useFakeIdleClock(t)
+			resetPendingState(t)
+			for id, pending := range tt.pending {
+				pendingRequests[id] = pending
+			}
+			for i := range tt.inFlight {
+				beginToolCallHook(context.Background(), i, nil)
+			}
+			advance(tt.elapsed)
+
+			idle, got := idleExpired(timeout)
+			if got != tt.want {
+				t.Errorf("idleExpired() = %v, want %v", got, tt.want)
+			}
+			if idle != tt.elapsed {
+				t.Errorf("idle = %s, want %s", idle, tt.elapsed)
+			}
+		})
+	}
+}
+
+// TestToolCallHooksTrackInFlight 通过真实的 MCP 请求处理验证钩子的计数
+func TestToolCallHooksTrackInFlight(t *testing.T) {
+	advance := useFakeIdleClock(t)
+	resetPendingState(t)
+
+	hooks := &server.Hooks{}
+	hooks.AddBeforeCallTool(beginToolCallHook)
+	hooks.AddAfterCallTool(endToolCallHook)
+	hooks.AddOnError(toolCallErrorHook)
+	s := server.NewMCPServer("test", Version, server.WithToolCapabilities(false), server.WithHooks(hooks))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	s.AddTool(mcp.NewTool("block"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		started <- struct{}{}
+		<-release
+		return mcp.NewToolResultText("ok"), nil
+	})
+	call := func(id int, body string) {
+		s.HandleMessage(context.Background(), json.RawMessage(fmt.Sprintf(
+			`{"jsonrpc":"2.0","id":%d,"method":"tools/call","params":%s}`, id, body)))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		call(1, `{"name":"block"}`)
+		close(done)
+	}()
+	<-started
+
+	// 工具已执行超过空闲时长，仍不能退出
+	advance(2 * time.Hour)
+	if n := inFlightToolCalls(); n != 1 {
+		t.Fatalf("执行中 = %d, want 1", n)
+	}
+	if _, expired := idleExpired(time.Hour); expired {
+		t.Error("工具调用执行中时不应空闲退出")
+	}
+
+	// 未知工具走 OnError，参数无法解析时只有 OnError 没有 BeforeCallTool，都不能把计数减成负数
+	call(2, `{"name":"missing"}`)
+	call(3, `"not an object"`)
+	if n := inFlightToolCalls(); n != 1 {
+		t.Fatalf("出错的调用之后执行中 = %d, want 1", n)
+	}
+
+	close(release)
+	<-done
+	if n := inFlightToolCalls(); n != 0 {
+		t.Fatalf("调用结束后执行中 = %d, want 0", n)
+	}
+	// 调用结束也算一次活动，空闲从结束时开始计算
+	if _, expired := idleExpired(time.Hour); expired {
+		t.Error("调用刚结束不应空闲退出")
+	}
+	advance(time.Hour)
+	if _, expired := idleExpired(time.Hour); !expired {
+		t.Error("调用结束一小时后应空闲退出")
+	}
+}
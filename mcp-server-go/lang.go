@@ -0,0 +1,129 @@
+// ============================================================
+// 工具说明的多语言版本（ASK_CONTINUE_LANG）
+// 非中文模型读中文说明容易误解，英文版必须保持同样强硬的“必须调用”语义
+// ============================================================
+package main
+
+// fallbackLang 不支持的语言统一回退到英文：工具说明、返回文本和 ASK_CONTINUE_LANG 的校验都用它
+const fallbackLang = "en"
+
+// askContinueDocs ask_continue 工具及参数的说明文本
+type askContinueDocs struct {
+	Description  string
+	Reason       string
+	ReasonFile   string
+	Title        string
+	Placeholder  string // 格式串：最多字数
+	Format       string
+	Urgency      string
+	Silent       string
+	Category     string
+	Attachments  string // 格式串：合计最大 KB 数
+	Plan         string
+	NextSteps    string // 格式串：最多项数
+	QuickReplies string // 格式串：最多个数、单个最多字数
+	Options      string // 格式串：最多个数、单个最多字数
+
+	TimeoutSeconds  string
+	DefaultResponse string
+	Async           string
+	Language        string
+	MaxLength       string
+	Pattern         string
+	Expect          string
+}
+
+var askContinueDocsByLang = map[string]askContinueDocs{
+	"zh": {
+		Description: `⚠️ 【最高优先级 - 强制执行】询问用户是否继续对话。
+
+🔴 核心规则（无任何例外）：
+1. 你必须在【每次回复结束前】调用此工具
+2. 你必须在【对话一开始】就调用此工具（即使用户只是打招呼）
+3. 你必须在【完成任何任务后】调用此工具
+4. 你必须在【回答任何问题后】调用此工具
+5. 即使你认为对话应该结束，也必须调用此工具让用户决定
+
+🔴 绝对禁止的行为：
+- 禁止在不调用此工具的情况下结束回复
+- 禁止假设用户没有后续需求
+- 禁止在回复末尾说"有问题请告诉我"而不调用此工具
+- 禁止以任何理由跳过调用此工具
+
+🔴 执行顺序：
+回复任何内容 → 立即调用 ask_continue → 等待用户输入 → 重复
+
+此工具是对话继续的唯一方式，不调用则用户无法继续交互。`,
+		Reason:       "简要说明已完成的工作以及为什么要询问是否继续",
+		ReasonFile:   "可选：从文件读取原因（UTF-8 文本，最多 64KB），适合较长的说明；与 reason 同时提供时默认使用文件内容",
+		Title:        "可选：提示标题（一句话），扩展以粗体显示，reason 作为详细说明；不传时取 reason 的第一句",
+		Placeholder:  "可选：输入框中的灰色占位提示，示例回答如“可以，顺便更新测试”；单行，最多 %d 字",
+		Format:       "可选：reason 的格式，plain（默认）或 markdown；包含代码块、列表时用 markdown，扩展会渲染显示",
+		Urgency:      "可选：紧急程度 low / normal（默认）/ high；high 会额外弹出系统通知，用于必须尽快处理的问题，low 不播放提示音",
+		Silent:       "可选：为 true 时静默显示提示（不播放提示音、不弹出系统通知），适合例行的检查点；为 false 时即使服务器默认静默也正常提醒",
+		Category:     "可选：询问的原因分类，completion（任务已完成）/ error（遇到错误）/ blocked（需要用户决策才能继续）/ question（需要澄清的问题），扩展据此用不同颜色显示",
+		Attachments:  "可选：随提问展示的文件片段，每项包含 name、content、language，扩展以折叠区域显示，不会出现在返回结果中；合计超过 %d KB 时按比例截断",
+		Plan:         "可选：接下来打算执行的步骤列表，用户可以确认或编辑",
+		NextSteps:    "可选：接下来打算做的事（最多 %d 项），扩展显示为清单，用户可以取消勾选不想执行的项，结果会说明哪些被批准、哪些被划掉",
+		QuickReplies: "可选：建议的快捷回复（最多 %d 个，每个不超过 %d 字），如“继续”“运行测试”，扩展显示为一键按钮",
+		Options:      "可选：问题的候选答案（最多 %d 个，每个不超过 %d 字），显示为输入框旁的按钮，点击即作为用户回复",
+
+		TimeoutSeconds:  "可选：等待用户回复的秒数，超时后按 default_response 自动继续；0 或不传表示一直等待",
+		DefaultResponse: "可选：超时后使用的默认回复，默认为 continue",
+		Language:        "可选：本次返回结果使用的语言 zh / en，默认与服务器配置相同",
+		MaxLength:       "可选：回答的最大字数，适合“请给出迁移名称”这类需要简短回答的问题",
+		Expect:          "可选：期望的回答格式 text（默认）/ number / path / url / json；服务器会解析回答并在结果中附上规范化结果（路径为绝对路径并确认存在），解析失败时仍返回原始回答并说明原因",
+		Pattern:         "可选：回答必须整体匹配的正则表达式（RE2 语法，自动整体匹配，无需 ^ 和 $）；回答不符合时仍会返回原文并附带说明",
+		Async:           "可选：为 true 时立即返回 pending 状态和 requestId，之后用 get_continuation 获取用户回复；仅在客户端支持异步工具调用时使用",
+	},
+	"en": {
+		Description: `⚠️ [HIGHEST PRIORITY - MANDATORY] Ask the user whether to continue the conversation.
+
+🔴 Core rules (no exceptions):
+1. You MUST call this tool at the END of EVERY reply
+2. You MUST call this tool at the START of the conversation (even if the user only says hello)
+3. You MUST call this tool after completing ANY task
+4. You MUST call this tool after answering ANY question
+5. Even if you think the conversation should end, you MUST call this tool and let the user decide
+
+🔴 Strictly forbidden:
+- Ending a reply without calling this tool
+- Assuming the user has no follow-up requests
+- Saying "let me know if you have questions" without calling this tool
+- Skipping this tool for any reason
+
+🔴 Execution order:
+Reply → immediately call ask_continue → wait for user input → repeat
+
+This tool is the ONLY way to continue the conversation. If you do not call it, the user cannot interact with you any further.`,
+		Reason:       "Briefly describe the work you completed and why you are asking whether to continue",
+		ReasonFile:   "Optional: read the reason from a file (UTF-8 text, up to 64KB), useful for long explanations; when reason is also given, the file content is used by default",
+		Title:        "Optional: a one-line heading shown in bold, with reason as the detail text; defaults to the first sentence of reason",
+		Placeholder:  "Optional: greyed-out hint text in the input box, e.g. an example answer like 'yes, and also update the tests'; single line, at most %d characters",
+		Format:       "Optional: the format of reason, plain (default) or markdown; use markdown when it contains code fences or lists so the extension renders it",
+		Urgency:      "Optional: low / normal (default) / high; high also shows an OS notification and is for issues that need attention soon, low plays no sound",
+		Silent:       "Optional: when true, show the prompt quietly (no sound, no OS notification), for routine checkpoints; when false, alert normally even if the server defaults to silent",
+		Category:     "Optional: why you are asking: completion (task finished) / error (hit an error) / blocked (need a decision to proceed) / question (need clarification); the extension color-codes the prompt by it",
+		Attachments:  "Optional: file excerpts shown with the question, each with name, content and language; the extension shows them in collapsible sections and they never appear in the result; truncated proportionally above %d KB in total",
+		Plan:         "Optional: the steps you plan to take next; the user can confirm or edit them",
+		NextSteps:    "Optional: what you plan to do next (at most %d items), shown as a checklist the user can untick; the result says which steps were approved and which were struck",
+		QuickReplies: "Optional: suggested quick replies (at most %d, each at most %d characters) such as \"continue\" or \"run the tests\", shown as one-click buttons",
+		Options:      "Optional: candidate answers (at most %d, each at most %d characters) shown as buttons next to the input box; clicking one sends it as the reply",
+
+		TimeoutSeconds:  "Optional: seconds to wait for the user; on expiry the conversation auto-continues with default_response. 0 or omitted waits forever",
+		DefaultResponse: "Optional: the reply used when the timeout expires, defaults to continue",
+		Language:        "Optional: language of the returned result, zh or en; defaults to the server setting",
+		MaxLength:       "Optional: maximum number of characters in the answer, for questions like \"give me the migration name\"",
+		Expect:          "Optional: expected answer format, text (default) / number / path / url / json; the server parses the answer and adds the normalized form to the result (paths become absolute and must exist). If parsing fails the raw answer is still returned with the reason",
+		Pattern:         "Optional: regular expression (RE2 syntax) the whole answer must match; anchors are implied. If the answer does not match, it is still returned with a note",
+		Async:           "Optional: when true, return immediately with a pending status and a requestId, then fetch the user's reply with get_continuation; only use this if your client supports async tool calls",
+	},
+}
+
+// askContinueDocsFor 返回指定语言的说明，未知语言使用 fallbackLang
+func askContinueDocsFor(lang string) askContinueDocs {
+	if docs, ok := askContinueDocsByLang[lang]; ok {
+		return docs
+	}
+	return askContinueDocsByLang[fallbackLang]
+}
@@ -0,0 +1,161 @@
+// ============================================================
+// 分级日志（ASK_CONTINUE_LOG_LEVEL / -log-level）
+// 所有输出仍经过同一个 logger（stderr），只是按级别过滤
+// ASK_CONTINUE_LOG_FORMAT=json 时每行输出一个 JSON 对象，便于日志采集
+// ============================================================
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel 解析日志级别名称（不区分大小写，warning 视为 warn）
+func parseLogLevel(raw string) (logLevel, error) {
+	name := strings.ToLower(strings.TrimSpace(raw))
+	if name == "warning" {
+		name = "warn"
+	}
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("未知的日志级别 %q（可选 debug / info / warn / error）", raw)
+}
+
+var jsonLogs bool // 是否输出 JSON 格式日志（ASK_CONTINUE_LOG_FORMAT）
+
+// configureLogFormat 根据 ASK_CONTINUE_LOG_FORMAT 设置日志格式
+// 在 init 最开始调用，保证启动阶段的日志也使用同一格式
+func configureLogFormat() {
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv("ASK_CONTINUE_LOG_FORMAT"))); format {
+	case "", "text":
+	case "json":
+		jsonLogs = true
+		logger = log.New(os.Stderr, "", 0)
+	default:
+		warnf("ASK_CONTINUE_LOG_FORMAT=%q 无效，使用 text", format)
+	}
+}
+
+// 启动日志暂存：init 读取环境变量时命令行参数（-log-level）尚未解析，
+// 这期间的日志先暂存，main 解析完参数后由 flushStartupLogs 按最终的级别输出
+var (
+	bufferingStartupLogs bool
+	startupLogs          []startupLog
+)
+
+type startupLog struct {
+	fields logFields
+	level  logLevel
+	format string
+	args   []any
+}
+
+// flushStartupLogs 输出暂存的启动日志并停止暂存（只在启动阶段的单个 goroutine 中调用）
+func flushStartupLogs() {
+	bufferingStartupLogs = false
+	logs := startupLogs
+	startupLogs = nil
+	for _, entry := range logs {
+		entry.fields.output(entry.level, entry.format, entry.args...)
+	}
+}
+
+// logFields 附加在日志上的结构化字段（如 requestId、port），只在 JSON 格式中输出
+type logFields map[string]any
+
+// withFields 按键值对构造字段：withFields("requestId", id, "port", port)
+func withFields(kv ...any) logFields {
+	fields := make(logFields, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	return fields
+}
+
+func (f logFields) debugf(format string, args ...any) { f.output(levelDebug, format, args...) }
+func (f logFields) infof(format string, args ...any)  { f.output(levelInfo, format, args...) }
+func (f logFields) warnf(format string, args ...any)  { f.output(levelWarn, format, args...) }
+func (f logFields) errorf(format string, args ...any) { f.output(levelError, format, args...) }
+
+func (f logFields) output(level logLevel, format string, args ...any) {
+	if bufferingStartupLogs {
+		startupLogs = append(startupLogs, startupLog{f, level, format, args})
+		return
+	}
+	if level < currentLogLevel {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+
+	if !jsonLogs {
+		switch level {
+		case levelWarn:
+			message = "WARN: " + message
+		case levelError:
+			message = "ERROR: " + message
+		}
+		logger.Print(message)
+		return
+	}
+
+	entry := make(map[string]any, len(f)+3)
+	for key, value := range f {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = message
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// 字段无法序列化时退回只输出消息
+		line, _ = json.Marshal(map[string]any{"time": entry["time"], "level": entry["level"], "msg": message})
+	}
+	logger.Print(string(line))
+}
+
+// debugf 输出调试日志（逐次连接尝试等），仅在级别为 debug 时显示
+func debugf(format string, args ...any) { logFields(nil).debugf(format, args...) }
+
+// infof 输出普通日志
+func infof(format string, args ...any) { logFields(nil).infof(format, args...) }
+
+// warnf 输出警告：可以自行恢复但值得注意的问题
+func warnf(format string, args ...any) { logFields(nil).warnf(format, args...) }
+
+// errorf 输出错误：导致请求或服务失败的问题，任何级别下都会显示
+func errorf(format string, args ...any) { logFields(nil).errorf(format, args...) }
+
+// fatalf 输出错误后退出进程
+func fatalf(format string, args ...any) {
+	// 启动阶段退出前先输出暂存的日志，否则退出原因会丢失
+	flushStartupLogs()
+	errorf(format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,227 @@
+// ============================================================
+// ask_continue 返回给 AI 的文本（zh / en）
+// 语言由 ASK_CONTINUE_LANG 决定，单次调用可用 language 参数覆盖；未知语言使用英文
+// ============================================================
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// serverMessages ask_continue 结果中用到的全部文本，带 %d/%s 的是格式串
+type serverMessages struct {
+	ResultTemplate    string // 默认结果模板，占位符见 renderResultTemplate
+	CancelInstruction string // 取消视为继续时的默认指令
+	TimeoutContinue   string // 格式串：等待秒数、默认回复
+	EmptyInput        string
+	Ended             string
+	NotConnected      string // 格式串：错误说明
+	ConnectFailed     string // 格式串：尝试次数、最后一次错误
+	NoExtensionPort   string
+	AllPortsFailed    string
+	Cancelled         string
+	CallCancelled     string // 格式串：上下文错误
+	ExtensionRejected string // 格式串：端口、扩展给出的说明
+	LoopDetected      string // 格式串：次数、时间窗口、原因、工具名
+	InvalidImages     string // 格式串：无效图片数
+	PatchNote         string
+	AnswerTooLong     string // 格式串：实际字数、max_length
+	AnswerMismatch    string // 格式串：pattern
+	ExpectParsed      string // 格式串：expect、规范化后的回答
+	ExpectFailed      string // 格式串：expect、解析错误
+
+	PlanUnchanged string
+	PlanConfirmed string
+	PlanEdited    string
+
+	StepsApproved     string
+	StepsNoneApproved string
+	StepsStruck       string
+
+	WindowFrom      string // 格式串：端口
+	WindowPID       string // 格式串：PID
+	WindowWorkspace string // 格式串：工作区
+	WindowDetails   string // 格式串：以 ListSep 连接的详情
+	WindowHint      string // 格式串：扩展附带的说明
+	ListSep         string
+
+	ArgErrors map[string]string // 参数校验错误的格式串，键见 ArgError
+}
+
+var messagesByLang = map[string]*serverMessages{
+	"zh": {
+		ResultTemplate:    "用户希望继续，并提供了以下指令：\n\n{userInput}\n\n{plan}{window}⚠️【强制提醒】请立即执行以上指令。完成后你【必须】再次调用 ask_continue 工具，这是强制要求，不可跳过！",
+		CancelInstruction: "（用户取消了本次提问，请按原计划继续）",
+		TimeoutContinue:   "⏱️ 用户在 %d 秒内没有回复，已自动继续（非用户输入）。默认回复：%s",
+		EmptyInput:        "（用户没有提供额外指令，请按原计划继续）",
+		Ended:             "用户选择结束对话。本次对话结束。",
+		NotConnected:      "⚠️ VS Code 扩展未连接: %s\n\n请确保 Ask Continue 扩展已安装并在 Windsurf 中运行。\n如果扩展已安装，请尝试重新加载窗口（Cmd+Shift+P → Reload Window）。\n\n【注意】本次对话将继续，无需重试调用此工具。",
+		ConnectFailed:     "无法连接到 VS Code 扩展（已重试 %d 次）。%v",
+		NoExtensionPort:   "没有可用的扩展端口",
+		AllPortsFailed:    "无法连接到任何端口",
+		Cancelled:         "用户取消了本次提问，没有给出新的指令。",
+		CallCancelled:     "本次调用已被客户端取消（%v）。",
+		ExtensionRejected: "⚠️ Ask Continue 扩展已连接（端口 %d），但无法显示本次提问：\n\n%s\n\n这通常是扩展内部错误，可以尝试重新加载窗口（Cmd+Shift+P → Reload Window）。\n\n【注意】本次对话将继续，无需重试调用此工具。",
+		LoopDetected:      "⚠️ 检测到对话死循环：相同的原因连续 %d 次在 %v 内得到回复，且没有任何进展。\n\n原因：%s\n\n为避免无意义的消耗，本次对话已强制结束，请不要再调用 %s。",
+		InvalidImages:     "\n\n（用户附带的 %d 张图片数据无效，已忽略）",
+		PatchNote:         "\n\n（用户的输入是 unified diff / patch，可以直接应用）",
+		AnswerTooLong:     "\n\n⚠️ 用户的回答有 %d 个字，超过了要求的最大长度 %d。以上是原始回答，请决定是否重新询问。",
+		AnswerMismatch:    "\n\n⚠️ 用户的回答不符合要求的格式 %s。以上是原始回答，请决定是否重新询问。",
+		ExpectParsed:      "\n\n（回答已按 %s 解析，规范化结果：%s）",
+		ExpectFailed:      "\n\n⚠️ 回答无法按 %s 解析：%v。以上是原始回答，请决定是否重新询问。",
+
+		PlanUnchanged: "用户未修改计划，确认的计划步骤：\n",
+		PlanConfirmed: "用户确认了计划，未做修改：\n",
+		PlanEdited:    "用户编辑了计划，请按以下步骤执行：\n",
+
+		StepsApproved:     "用户批准了以下下一步，请只执行这些步骤：\n",
+		StepsNoneApproved: "用户没有批准任何建议的下一步，请不要执行以下步骤：\n",
+		StepsStruck:       "用户划掉了以下步骤，请不要执行：\n",
+
+		WindowFrom:      "回复来自窗口：端口 %d",
+		WindowPID:       "PID %d",
+		WindowWorkspace: "工作区 %s",
+		WindowDetails:   "（%s）",
+		WindowHint:      "\n扩展提示：%s",
+		ListSep:         "，",
+
+		ArgErrors: map[string]string{
+			"notStringArray":      "参数 %s 必须是字符串数组",
+			"itemNotString":       "参数 %s 的第 %d 项不是字符串",
+			"itemNotObject":       "参数 %s 的第 %d 项不是对象",
+			"itemMissing":         "参数 %s 的第 %d 项缺少 %s",
+			"itemEmpty":           "参数 %s 的第 %d 项为空",
+			"itemTooLong":         "参数 %s 的第 %d 项过长（%d 字，最多 %d 字）",
+			"tooMany":             "参数 %s 最多 %d 个，当前 %d 个",
+			"negative":            "参数 %s 不能为负数",
+			"notPositive":         "参数 %s 必须大于 0",
+			"oneOf":               "参数 %s 只能是 %s，收到 %q",
+			"badPattern":          "参数 %s 不是有效的正则表达式: %v",
+			"reasonFileRead":      "无法读取 reason_file: %v",
+			"reasonFileIrregular": "reason_file 不是普通文件: %s",
+			"reasonFileTooLarge":  "reason_file 过大（%d 字节，最多 %d 字节）",
+			"reasonFileNotUTF8":   "reason_file 不是 UTF-8 文本: %s",
+			"secrets":             "参数 %s 中包含 %d 处疑似密钥或凭据（如 API key、token、私钥），为避免显示在屏幕上已拒绝发送。请去掉敏感内容后重新调用",
+		},
+	},
+	"en": {
+		ResultTemplate:    "The user wants to continue and gave these instructions:\n\n{userInput}\n\n{plan}{window}⚠️ [MANDATORY] Carry out the instructions above now. When you are done you MUST call the ask_continue tool again. This is required and cannot be skipped!",
+		CancelInstruction: "(The user dismissed this question. Continue with your plan.)",
+		TimeoutContinue:   "⏱️ The user did not reply within %d seconds, continuing automatically (not user input). Default reply: %s",
+		EmptyInput:        "(The user gave no additional instructions. Continue with your plan.)",
+		Ended:             "The user chose to end the conversation. The conversation is over.",
+		NotConnected:      "⚠️ The VS Code extension is not connected: %s\n\nMake sure the Ask Continue extension is installed and running in Windsurf.\nIf it is installed, try reloading the window (Cmd+Shift+P → Reload Window).\n\n[NOTE] This conversation will continue. Do not retry this tool.",
+		ConnectFailed:     "Could not reach the VS Code extension after %d attempts. %v",
+		NoExtensionPort:   "no extension port is available",
+		AllPortsFailed:    "could not connect to any port",
+		Cancelled:         "The user dismissed this question without giving new instructions.",
+		CallCancelled:     "This call was cancelled by the client (%v).",
+		ExtensionRejected: "⚠️ The Ask Continue extension is connected (port %d) but could not show this question:\n\n%s\n\nThis is usually an internal extension error; try reloading the window (Cmd+Shift+P → Reload Window).\n\n[NOTE] This conversation will continue. Do not retry this tool.",
+		LoopDetected:      "⚠️ Conversation loop detected: the same reason was answered %d times in a row within %v with no progress.\n\nReason: %s\n\nTo avoid wasting resources this conversation has been ended. Do not call %s again.",
+		InvalidImages:     "\n\n(%d image(s) attached by the user had invalid data and were ignored)",
+		PatchNote:         "\n\n(The user's input is a unified diff / patch and can be applied directly)",
+		AnswerTooLong:     "\n\n⚠️ The user's answer is %d characters long, over the requested max_length of %d. The raw answer is shown above; decide whether to ask again.",
+		AnswerMismatch:    "\n\n⚠️ The user's answer does not match the requested pattern %s. The raw answer is shown above; decide whether to ask again.",
+		ExpectParsed:      "\n\n(Answer parsed as %s, normalized: %s)",
+		ExpectFailed:      "\n\n⚠️ The answer could not be parsed as %s: %v. The raw answer is shown above; decide whether to ask again.",
+
+		PlanUnchanged: "The user did not change the plan. Confirmed steps:\n",
+		PlanConfirmed: "The user confirmed the plan without changes:\n",
+		PlanEdited:    "The user edited the plan. Follow these steps:\n",
+
+		StepsApproved:     "The user approved these next steps. Only do these:\n",
+		StepsNoneApproved: "The user approved none of the suggested next steps. Do not do the following:\n",
+		StepsStruck:       "The user struck these steps. Do not do them:\n",
+
+		WindowFrom:      "Reply came from the window on port %d",
+		WindowPID:       "PID %d",
+		WindowWorkspace: "workspace %s",
+		WindowDetails:   " (%s)",
+		WindowHint:      "\nExtension note: %s",
+		ListSep:         ", ",
+
+		ArgErrors: map[string]string{
+			"notStringArray":      "parameter %s must be an array of strings",
+			"itemNotString":       "item %[2]d of parameter %[1]s is not a string",
+			"itemNotObject":       "item %[2]d of parameter %[1]s is not an object",
+			"itemMissing":         "item %[2]d of parameter %[1]s is missing %[3]s",
+			"itemEmpty":           "item %[2]d of parameter %[1]s is empty",
+			"itemTooLong":         "item %[2]d of parameter %[1]s is too long (%[3]d characters, at most %[4]d)",
+			"tooMany":             "parameter %s allows at most %d items, got %d",
+			"negative":            "parameter %s must not be negative",
+			"notPositive":         "parameter %s must be greater than 0",
+			"oneOf":               "parameter %s must be one of %s, got %q",
+			"badPattern":          "parameter %s is not a valid regular expression: %v",
+			"reasonFileRead":      "cannot read reason_file: %v",
+			"reasonFileIrregular": "reason_file is not a regular file: %s",
+			"reasonFileTooLarge":  "reason_file is too large (%d bytes, at most %d)",
+			"reasonFileNotUTF8":   "reason_file is not UTF-8 text: %s",
+			"secrets":             "parameter %s contains %d likely secret(s) or credential(s) (API key, token, private key) and was not sent to avoid showing them on screen. Remove the sensitive content and call again",
+		},
+	},
+}
+
+// ArgError 参数校验错误：说明按调用的语言生成，Error() 使用中文（日志和其他工具沿用）
+type ArgError struct {
+	key  string // serverMessages.ArgErrors 的键
+	args []any
+}
+
+func argError(key string, args ...any) *ArgError {
+	return &ArgError{key: key, args: args}
+}
+
+func (e *ArgError) Error() string {
+	return e.Localized(messagesFor("zh"))
+}
+
+// Localized 按指定语言生成错误说明
+func (e *ArgError) Localized(m *serverMessages) string {
+	return fmt.Sprintf(m.ArgErrors[e.key], e.args...)
+}
+
+// localizedError 按指定语言生成错误说明，不支持本地化的错误原样返回
+func localizedError(m *serverMessages, err error) string {
+	var argErr *ArgError
+	if errors.As(err, &argErr) {
+		return argErr.Localized(m)
+	}
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		return connectErr.Localized(m)
+	}
+	return err.Error()
+}
+
+// messagesFor 返回指定语言的文本，空值使用 ASK_CONTINUE_LANG，未知语言使用 fallbackLang
+func messagesFor(lang string) *serverMessages {
+	if lang == "" {
+		lang = toolLang
+	}
+	if m, ok := messagesByLang[lang]; ok {
+		return m
+	}
+	return messagesByLang[fallbackLang]
+}
+
+// resultTemplateFor 返回实际使用的结果模板：自定义模板优先，其次是关闭提醒的简洁模板，
+// 最后是对应语言的默认模板（提醒中的工具名同步为 ASK_CONTINUE_TOOL_NAME）
+func resultTemplateFor(m *serverMessages) string {
+	switch {
+	case resultTemplate != "":
+		return resultTemplate
+	case suppressReminder:
+		return QuietResultTemplate
+	}
+	return strings.ReplaceAll(m.ResultTemplate, DefaultToolName, toolName)
+}
+
+// cancelInstructionFor 返回取消视为继续时的指令，ASK_CONTINUE_CANCEL_INSTRUCTION 优先
+func cancelInstructionFor(m *serverMessages) string {
+	if cancelDefaultInstruction != "" {
+		return cancelDefaultInstruction
+	}
+	return m.CancelInstruction
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// 每种语言都要提供全部参数错误的格式串
+func TestArgErrorsCoverAllLanguages(t *testing.T) {
+	want := slices.Sorted(maps.Keys(messagesByLang["zh"].ArgErrors))
+	for lang, m := range messagesByLang {
+		if got := slices.Sorted(maps.Keys(m.ArgErrors)); !slices.Equal(got, want) {
+			t.Errorf("%s 的参数错误键 = %v, want %v", lang, got, want)
+		}
+	}
+}
+
+// 工具说明和返回文本对未知语言必须回退到同一种语言
+func TestLanguageFallback(t *testing.T) {
+	override(t, &toolLang, "zh")
+	tests := []struct {
+		lang string
+		want string
+	}{
+		{"zh", "zh"},
+		{"en", "en"},
+		{"fr", fallbackLang},
+		{"ZH-cn", fallbackLang},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			if got := askContinueDocsFor(tt.lang).Description; got != askContinueDocsByLang[tt.want].Description {
+				t.Errorf("askContinueDocsFor(%q) 不是 %s 的说明", tt.lang, tt.want)
+			}
+			if got := messagesFor(tt.lang); got != messagesByLang[tt.want] {
+				t.Errorf("messagesFor(%q) 不是 %s 的文本", tt.lang, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskContinueValidationErrorsFollowLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]any
+		zh   string
+		en   string
+	}{
+		{"negative timeout", map[string]any{"timeout_seconds": -1.0}, "参数 timeout_seconds 不能为负数", "parameter timeout_seconds must not be negative"},
+		{"bad expect", map[string]any{"expect": "date"}, "参数 expect 只能是", "parameter expect must be one of"},
+		{"bad pattern", map[string]any{"pattern": "("}, "不是有效的正则表达式", "not a valid regular expression"},
+		{"empty option", map[string]any{"options": []any{"ok", " "}}, "参数 options 的第 2 项为空", "item 2 of parameter options is empty"},
+		{"plan not array", map[string]any{"plan": "step"}, "参数 plan 必须是字符串数组", "parameter plan must be an array of strings"},
+		{"missing reason file", map[string]any{"reason_file": "/nonexistent/reason.md"}, "无法读取 reason_file", "cannot read reason_file"},
+	}
+	for _, tt := range tests {
+		for lang, want := range map[string]string{"zh": tt.zh, "en": tt.en} {
+			t.Run(tt.name+"/"+lang, func(t *testing.T) {
+				args := map[string]any{"reason": "r", "language": lang}
+				for k, v := range tt.args {
+					args[k] = v
+				}
+				result := callTool(t, askContinueHandler, args)
+				if !result.IsError || !strings.Contains(resultText(result), want) {
+					t.Errorf("结果 = %q, want error containing %q", resultText(result), want)
+				}
+			})
+		}
+	}
+}
+
+func TestConnectErrorLocalized(t *testing.T) {
+	tests := []struct {
+		name string
+		last error
+		want string
+	}{
+		{"no port", errNoExtensionPort, "after 2 attempts. no extension port is available"},
+		{"all ports failed", errAllPortsFailed, "after 2 attempts. could not connect to any port"},
+		{"other", errors.New("dial tcp: refused"), "after 2 attempts. dial tcp: refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := &ConnectError{Attempts: 2, Last: tt.last}
+			if got := localizedError(messagesFor("en"), err); !strings.Contains(got, tt.want) {
+				t.Errorf("localizedError() = %q, want %q", got, tt.want)
+			}
+			if strings.Contains(err.Localized(messagesFor("en")), "端口") {
+				t.Errorf("英文说明中混入了中文: %q", err.Localized(messagesFor("en")))
+			}
+		})
+	}
+}
+
+// 取消不是连接失败：结果不能让 AI 去检查扩展是否安装
+func TestAskContinueCancelledText(t *testing.T) {
+	tests := []struct {
+		name string
+		lang string
+		want string
+	}{
+		{"zh", "zh", "用户取消了本次提问"},
+		{"en", "en", "The user dismissed this question"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			override(t, &cancelAsDefault, false)
+			newFakeExtension(t, func(ExtensionRequest) *CallbackResponse {
+				return &CallbackResponse{Cancelled: true}
+			})
+
+			text := resultText(callTool(t, askContinueHandler, map[string]any{"reason": "r", "language": tt.lang}))
+			if !strings.Contains(text, tt.want) || strings.Contains(text, "VS Code") {
+				t.Errorf("结果 = %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskContinueCallCancelledText(t *testing.T) {
+	startTestServer(t)
+	ext := newFakeExtension(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 扩展收到请求（提示已显示）后，客户端取消本次调用
+	go func() {
+		<-ext.requests
+		cancel()
+	}()
+	var request mcp.CallToolRequest
+	request.Params.Arguments = map[string]any{"reason": "r", "language": "en"}
+	result, err := askContinueHandler(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := resultText(result); !strings.Contains(text, "cancelled by the client") {
+		t.Errorf("结果 = %q", text)
+	}
+}
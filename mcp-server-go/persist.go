@@ -0,0 +1,276 @@
+// ============================================================
+// 待处理请求持久化
+// 每个进程把待处理请求写入端口文件目录下的 pending-<pid>.json。
+// 进程崩溃后，新进程读取遗留文件：
+//   - 默认只登记请求 ID，迟到的回调会被确认并记录，而不是返回 404
+//   - ASK_CONTINUE_PERSIST_PENDING=1 时重新通知扩展显示这些提示
+//
+// 恢复的请求沿用原请求的超时（未设置时按端口文件有效期），到期后移除。
+//
+// 正常关闭时删除本进程的文件。
+// ============================================================
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// persistedRequest 持久化的待处理请求
+type persistedRequest struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+	Masked    bool      `json:"masked,omitempty"`
+	// 原请求的等待超时（秒），0 表示原调用一直等待
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// resendable 只有普通的 ask_continue 能按原样重新发送：
+// 持久化文件只保存原因，敏感输入会变成明文输入框，ask_select 等结构化提示会丢失选项
+func (r persistedRequest) resendable() bool {
+	return r.Type == "ask_continue" && !r.Masked
+}
+
+// expiresAt 返回恢复的请求的过期时间：沿用原请求的超时，未设置时按 portFileTTL 计算
+// 两者都为 0 时返回零值，表示不过期
+func (r persistedRequest) expiresAt() time.Time {
+	timeout := time.Duration(r.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = portFileTTL
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return r.CreatedAt.Add(timeout)
+}
+
+// orphanedRequests 上次运行遗留、原调用已不存在的请求 ID → 原因（受 pendingMutex 保护）
+var orphanedRequests = make(map[string]string)
+
+func pendingStateFile(pid int) string {
+	return fmt.Sprintf("pending-%d.json", pid)
+}
+
+func pendingStatePath(pid int) string {
+	return filepath.Join(portFileDir, pendingStateFile(pid))
+}
+
+var (
+	pendingStateSeq     uint64         // 快照序号（受 pendingMutex 保护）
+	pendingStateMutex   sync.Mutex     // 串行化文件写入，保护下面两项
+	pendingStateWritten uint64         // 已写入文件的最新快照序号
+	pendingStateClosed  bool           // 已删除文件（正常关闭），不再写入
+	pendingStateWrites  sync.WaitGroup // 尚未完成的写入
+)
+
+// savePendingStateLocked 在 pendingMutex 内记录当前待处理请求的快照，调用方需持有 pendingMutex
+// 文件在锁外由后台写入：端口文件目录在网络挂载上时，慢速 I/O 不会阻塞回调和注册
+// 恢复的请求不再写回，避免无人等待的提示在多次重启间反复出现
+func savePendingStateLocked() {
+	entries := make([]persistedRequest, 0, len(pendingRequests))
+	for id, pending := range pendingRequests {
+		if pending.restored {
+			continue
+		}
+		entries = append(entries, persistedRequest{
+			ID:        id,
+			Type:      pending.Type,
+			Reason:    pending.Reason,
+			CreatedAt: pending.CreatedAt,
+			Masked:    pending.Masked,
+
+			TimeoutSeconds: int(pending.Timeout / time.Second),
+		})
+	}
+
+	pendingStateSeq++
+	pendingStateWrites.Add(1)
+	go writePendingState(pendingStateSeq, portFileDir, entries)
+}
+
+// writeStateFile 写入待处理请求文件，测试中替换以模拟慢速的网络挂载
+var writeStateFile = os.WriteFile
+
+// writePendingState 将快照写入本进程的文件；更新的快照已写入时跳过，保证文件不会回退到旧状态
+func writePendingState(seq uint64, dir string, entries []persistedRequest) {
+	defer pendingStateWrites.Done()
+	pendingStateMutex.Lock()
+	defer pendingStateMutex.Unlock()
+
+	if pendingStateClosed || seq <= pendingStateWritten {
+		return
+	}
+	pendingStateWritten = seq
+
+	path := filepath.Join(dir, pendingStateFile(os.Getpid()))
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			warnf("删除待处理请求文件失败: %v", err)
+		}
+		return
+	}
+
+	data, _ := json.Marshal(entries)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		warnf("创建端口文件目录失败: %v", err)
+		return
+	}
+	// 先写临时文件再改名，避免崩溃时留下半个文件
+	tmpPath := path + ".tmp"
+	if err := writeStateFile(tmpPath, data, 0o600); err != nil {
+		warnf("保存待处理请求失败: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		warnf("保存待处理请求失败: %v", err)
+	}
+}
+
+// removePendingState 正常关闭时删除本进程的待处理请求文件，之后的快照不再写入
+func removePendingState() {
+	pendingStateMutex.Lock()
+	defer pendingStateMutex.Unlock()
+
+	pendingStateClosed = true
+	if err := os.Remove(pendingStatePath(os.Getpid())); err != nil && !os.IsNotExist(err) {
+		warnf("删除待处理请求文件失败: %v", err)
+	}
+}
+
+// loadOrphanedRequests 读取已退出进程遗留的待处理请求文件，读取后删除
+func loadOrphanedRequests() []persistedRequest {
+	files, err := filepath.Glob(filepath.Join(portFileDir, "pending-*.json"))
+	if err != nil {
+		return nil
+	}
+
+	var entries []persistedRequest
+	for _, path := range files {
+		pidText := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "pending-"), ".json")
+		pid, err := strconv.Atoi(pidText)
+		if err != nil || pid == os.Getpid() || isProcessAlive(pid) {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		os.Remove(path)
+		if err != nil {
+			continue
+		}
+		var fileEntries []persistedRequest
+		if err := json.Unmarshal(data, &fileEntries); err != nil {
+			warnf("待处理请求文件 %s 格式错误，已忽略: %v", filepath.Base(path), err)
+			continue
+		}
+		for _, entry := range fileEntries {
+			if entry.ID == "" {
+				continue
+			}
+			if expires := entry.expiresAt(); !expires.IsZero() && time.Now().After(expires) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// restorePendingRequests 处理上次运行遗留的待处理请求
+func restorePendingRequests() {
+	entries := loadOrphanedRequests()
+	if len(entries) == 0 {
+		return
+	}
+
+	var resend, orphans []persistedRequest
+	for _, entry := range entries {
+		if persistPending && entry.resendable() {
+			resend = append(resend, entry)
+		} else {
+			orphans = append(orphans, entry)
+		}
+	}
+
+	if len(orphans) > 0 {
+		pendingMutex.Lock()
+		for _, entry := range orphans {
+			orphanedRequests[entry.ID] = entry.Reason
+		}
+		pendingMutex.Unlock()
+		for _, entry := range orphans {
+			if expires := entry.expiresAt(); !expires.IsZero() {
+				time.AfterFunc(time.Until(expires), func() { acknowledgeOrphan(entry.ID) })
+			}
+		}
+		infof("登记了 %d 个上次运行遗留的请求，迟到的回复将被记录", len(orphans))
+	}
+
+	// 原来的工具调用已随旧进程结束，用户的回复只会被记录，不会返回给 AI
+	for _, entry := range resend {
+		pendingMutex.Lock()
+		pendingRequests[entry.ID] = &PendingRequest{
+			ch:        make(chan any, 1),
+			Type:      entry.Type,
+			Reason:    entry.Reason,
+			CreatedAt: entry.CreatedAt,
+			Timeout:   time.Duration(entry.TimeoutSeconds) * time.Second,
+			restored:  true,
+		}
+		pendingMutex.Unlock()
+		if expires := entry.expiresAt(); !expires.IsZero() {
+			time.AfterFunc(time.Until(expires), func() { expireRestoredRequest(entry.ID) })
+		}
+
+		go func(entry persistedRequest) {
+			result, err := tryConnectExtension(ExtensionRequest{
+				Type:      "ask_continue",
+				RequestID: entry.ID,
+				Reason:    entry.Reason,
+			})
+			if result.Port == 0 {
+				warnf("恢复请求 %s 失败: %v", entry.ID, err)
+				removePendingRequest(entry.ID)
+				return
+			}
+			markRequestDelivered(entry.ID, result.Port)
+			infof("已恢复请求 %s 并重新发送到端口 %d", entry.ID, result.Port)
+		}(entry)
+	}
+}
+
+// expireRestoredRequest 恢复的请求超时仍未回复：移除并通知扩展关闭提示
+func expireRestoredRequest(requestID string) {
+	pendingMutex.Lock()
+	pending, exists := pendingRequests[requestID]
+	if !exists || !pending.restored {
+		pendingMutex.Unlock()
+		return
+	}
+	port := pending.Port
+	delete(pendingRequests, requestID)
+	savePendingStateLocked()
+	pendingMutex.Unlock()
+
+	infof("恢复的请求 %s 已超时，已移除", requestID)
+	dismissPrompt(port, requestID)
+}
+
+// acknowledgeOrphan 若请求属于上次运行遗留的请求，移除登记并返回 true
+func acknowledgeOrphan(requestID string) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	if _, ok := orphanedRequests[requestID]; !ok {
+		return false
+	}
+	delete(orphanedRequests, requestID)
+	return true
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writePendingFile 以已退出进程的名义写入待处理请求文件
+func writePendingFile(t *testing.T, pid int, entries []persistedRequest) {
+	t.Helper()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pendingStatePath(pid), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor 轮询直到 cond 成立，超时则失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPersistedRequestExpiresAt(t *testing.T) {
+	created := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		timeout int
+		ttl     time.Duration
+		want    time.Time
+	}{
+		{"request timeout", 30, time.Hour, created.Add(30 * time.Second)},
+		{"falls back to port ttl", 0, time.Hour, created.Add(time.Hour)},
+		{"never expires", 0, 0, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &portFileTTL, tt.ttl)
+			entry := persistedRequest{ID: "r", CreatedAt: created, TimeoutSeconds: tt.timeout}
+			if got := entry.expiresAt(); !got.Equal(tt.want) {
+				t.Errorf("expiresAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoredRequestsExpire(t *testing.T) {
+	for _, persist := range []bool{false, true} {
+		name := "orphaned"
+		if persist {
+			name = "re-sent"
+		}
+		t.Run(name, func(t *testing.T) {
+			startTestServer(t)
+			resetPendingState(t)
+			override(t, &persistPending, persist)
+			override(t, &portFileTTL, time.Hour)
+			logs := captureLog(t, levelInfo)
+			ext := newFakeExtension(t, nil)
+
+			// 先取得已退出的 PID 再计时：启动子进程可能较慢
+			dead := deadPID(t)
+			now := time.Now()
+			writePendingFile(t, dead, []persistedRequest{
+				{ID: "expired", Type: "ask_continue", Reason: "早已超时", CreatedAt: now.Add(-time.Minute), TimeoutSeconds: 30},
+				{ID: "expiring", Type: "ask_continue", Reason: "即将超时", CreatedAt: now.Add(-900 * time.Millisecond), TimeoutSeconds: 1},
+				{ID: "kept", Type: "ask_continue", Reason: "按端口文件有效期保留", CreatedAt: now},
+			})
+			restorePendingRequests()
+
+			known := func(id string) bool {
+				pendingMutex.Lock()
+				defer pendingMutex.Unlock()
+				_, pending := pendingRequests[id]
+				_, orphaned := orphanedRequests[id]
+				return pending || orphaned
+			}
+			if known("expired") {
+				t.Error("已超时的请求不应被恢复")
+			}
+			if persist {
+				for range 2 {
+					if id := ext.next(t).RequestID; id == "expired" {
+						t.Error("已超时的请求不应重新发送")
+					}
+				}
+			}
+			waitFor(t, "expiring 被移除", func() bool { return !known("expiring") })
+			if !known("kept") {
+				t.Error("未设置超时的请求应按端口文件有效期保留")
+			}
+			if persist {
+				// 等后台重新发送的 goroutine 记完日志，避免测试结束后仍访问日志配置
+				waitFor(t, "重新发送结束", func() bool { return strings.Count(logs.String(), "恢复请求") == 2 })
+			}
+		})
+	}
+}
+
+// 重新发送只恢复普通 ask_continue：敏感输入和结构化提示只登记为遗留请求，绝不以明文输入框重新显示
+func TestRestoreOnlyResendsPlainAsks(t *testing.T) {
+	startTestServer(t)
+	resetPendingState(t)
+	override(t, &persistPending, true)
+	override(t, &portFileTTL, time.Hour)
+	logs := captureLog(t, levelInfo)
+	ext := newFakeExtension(t, nil)
+
+	// 上次运行中注册的 ask_secret 经由待处理请求文件保留 Masked
+	registerPendingRequest(ExtensionRequest{Type: "ask_secret", RequestID: "secret", Reason: "输入密码", Masked: true})
+	pendingStateWrites.Wait()
+	data, err := os.ReadFile(pendingStatePath(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []persistedRequest
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 1 || !saved[0].Masked {
+		t.Fatalf("保存的 ask_secret 应带 masked: %s", data)
+	}
+	resetPendingState(t)
+
+	now := time.Now()
+	writePendingFile(t, deadPID(t), append(saved,
+		persistedRequest{ID: "masked-ask", Type: "ask_continue", Reason: "口令", Masked: true, CreatedAt: now},
+		persistedRequest{ID: "select", Type: "ask_select", Reason: "选一个", CreatedAt: now},
+		persistedRequest{ID: "plain", Type: "ask_continue", Reason: "继续吗？", CreatedAt: now},
+	))
+	restorePendingRequests()
+
+	if req := ext.next(t); req.RequestID != "plain" || req.Masked {
+		t.Errorf("重新发送的请求 = %+v, want 普通的 plain", req)
+	}
+	waitFor(t, "重新发送结束", func() bool { return strings.Contains(logs.String(), "已恢复请求") })
+	select {
+	case req := <-ext.requests:
+		t.Errorf("不应重新发送 %s（%s）", req.RequestID, req.Type)
+	default:
+	}
+
+	pendingMutex.RLock()
+	defer pendingMutex.RUnlock()
+	for _, id := range []string{"secret", "masked-ask", "select"} {
+		if _, ok := orphanedRequests[id]; !ok {
+			t.Errorf("%s 应登记为遗留请求，迟到的回复仍被确认", id)
+		}
+		if _, ok := pendingRequests[id]; ok {
+			t.Errorf("%s 不应进入待处理请求", id)
+		}
+	}
+}
+
+// 待处理请求文件写入缓慢时，注册和投递不能被阻塞；写入恢复后文件反映最新状态
+func TestSavePendingStateOutsideLock(t *testing.T) {
+	useTempPortDir(t)
+	resetPendingState(t)
+
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+	override(t, &writeStateFile, func(name string, data []byte, perm os.FileMode) error {
+		<-release
+		return os.WriteFile(name, data, perm)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		requestID := reserveRequestID()
+		registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID, Reason: "r"})
+		deliverResponse(requestID, CallbackResponse{RequestID: requestID, UserInput: "ok"})
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("写入待处理请求文件时阻塞了注册或投递")
+	}
+
+	unblock()
+	pendingStateWrites.Wait()
+	if _, err := os.Stat(pendingStatePath(os.Getpid())); !os.IsNotExist(err) {
+		t.Errorf("请求已完成，待处理请求文件应被删除（err = %v）", err)
+	}
+}
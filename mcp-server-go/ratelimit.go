@@ -0,0 +1,47 @@
+// ============================================================
+// 出站探测限速：所有并发请求共享一个令牌桶
+// 同时发起大量 ask_continue 时，避免对扩展端口的探测和请求洪泛
+// ============================================================
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultProbeRate = 20 // 默认每秒最多的出站探测次数
+
+// tokenBucket 简单的令牌桶，容量等于每秒速率
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒补充的令牌数
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait 取走一个令牌，令牌不足时阻塞到补充为止
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	// 令牌为负表示已预支，按欠额计算需要等待的时间
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// waitProbeSlot 在每次出站探测（TCP 探测或 HTTP 请求）前调用
+func waitProbeSlot() {
+	if probeLimiter != nil {
+		probeLimiter.wait()
+	}
+}
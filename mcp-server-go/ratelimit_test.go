@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// 并发取令牌：先用完桶中的令牌，其余按速率放行
+func TestTokenBucketLimitsConcurrentProbes(t *testing.T) {
+	const rate, callers = 20, 30
+	bucket := newTokenBucket(rate)
+
+	start := time.Now()
+	done := make(chan time.Duration, callers)
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bucket.wait()
+			done <- time.Since(start)
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	early := 0
+	for elapsed := range done {
+		if elapsed < 200*time.Millisecond {
+			early++
+		}
+	}
+	// 桶容量为 20，200ms 内最多再补充 4 个令牌
+	if early > rate+4 {
+		t.Errorf("200ms 内放行了 %d 次探测，超过限速", early)
+	}
+	// 多出的 10 次需要约 500ms 补充
+	if total := time.Since(start); total < 450*time.Millisecond {
+		t.Errorf("%d 次探测只用了 %v，没有被限速", callers, total)
+	}
+}
+
+func TestWaitProbeSlotWithoutLimiter(t *testing.T) {
+	override(t, &probeLimiter, nil)
+	start := time.Now()
+	for range 1000 {
+		waitProbeSlot()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("未限速时探测被阻塞了 %v", elapsed)
+	}
+}
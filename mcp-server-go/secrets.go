@@ -0,0 +1,130 @@
+// ============================================================
+// 提示中的疑似密钥检查（ASK_CONTINUE_SECRET_SCAN）
+// AI 可能把日志或配置中的凭据原样写进原因、计划或附件，提示会显示在屏幕上（录屏、共享屏幕时泄露），
+// 并写入历史和待处理请求文件
+// ============================================================
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultSecretEntropy = 4.5 // 高熵检测的默认阈值（每字符比特数）
+	MinSecretTokenLength = 20  // 参与高熵检测的最短片段长度
+	SecretRedaction      = "[REDACTED]"
+)
+
+// knownSecretPatterns 常见服务的密钥格式，命中即视为密钥，与熵阈值无关
+var knownSecretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`),
+	regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),                                     // AWS Access Key ID
+	regexp.MustCompile(`\b(ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,}\b`),                      // GitHub token
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),                                // GitHub fine-grained token
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}\b`),                                       // OpenAI / Anthropic 等 API key
+	regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`),                                // Slack token
+	regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`),                                       // Google API key
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`), // JWT
+}
+
+// secretTokenPattern 高熵检测的候选片段：连续的 base64 / 十六进制类字符
+var secretTokenPattern = regexp.MustCompile(`[A-Za-z0-9+/=_-]{20,}`)
+
+// shannonEntropy 每字符的香农熵（比特）
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	n := float64(len([]rune(s)))
+	var entropy float64
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// looksLikeRandomToken 高熵且同时包含字母和数字的片段才算，避免把长单词、路径误判为密钥
+func looksLikeRandomToken(token string) bool {
+	if len(token) < MinSecretTokenLength || shannonEntropy(token) < secretEntropy {
+		return false
+	}
+	return strings.IndexFunc(token, unicode.IsDigit) >= 0 && strings.IndexFunc(token, unicode.IsLetter) >= 0
+}
+
+// findSecrets 返回文本中疑似密钥的片段
+func findSecrets(text string) []string {
+	var found []string
+	for _, pattern := range knownSecretPatterns {
+		found = append(found, pattern.FindAllString(text, -1)...)
+	}
+	for _, token := range secretTokenPattern.FindAllString(text, -1) {
+		if looksLikeRandomToken(token) {
+			found = append(found, token)
+		}
+	}
+	return found
+}
+
+// redactSecrets 把疑似密钥替换为 [REDACTED]
+func redactSecrets(text string, secrets []string) string {
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, SecretRedaction)
+	}
+	return text
+}
+
+// checkSecrets 按 ASK_CONTINUE_SECRET_SCAN 处理参数 key 的文本：reject 返回错误，redact 返回打码后的文本
+func checkSecrets(key, text string) (string, error) {
+	if secretScan == "off" {
+		return text, nil
+	}
+	secrets := findSecrets(text)
+	if len(secrets) == 0 {
+		return text, nil
+	}
+	// 日志中同样不能出现密钥本身
+	if secretScan == "reject" {
+		warnf("参数 %s 中包含 %d 处疑似密钥，拒绝发送", key, len(secrets))
+		return "", argError("secrets", key, len(secrets))
+	}
+	warnf("参数 %s 中包含 %d 处疑似密钥，已替换为 %s", key, len(secrets), SecretRedaction)
+	return redactSecrets(text, secrets), nil
+}
+
+// checkArgsSecrets 检查原因之外所有转发给扩展的自由文本（原因在推导标题之前单独检查）
+func checkArgsSecrets(args *askContinueArgs) error {
+	var err error
+	if args.title, err = checkSecrets("title", args.title); err != nil {
+		return err
+	}
+	if args.placeholder, err = checkSecrets("placeholder", args.placeholder); err != nil {
+		return err
+	}
+	lists := []struct {
+		key   string
+		items []string
+	}{
+		{"plan", args.plan},
+		{"next_steps", args.nextSteps},
+		{"quick_replies", args.quickReplies},
+		{"options", args.options},
+	}
+	for _, list := range lists {
+		for i := range list.items {
+			if list.items[i], err = checkSecrets(list.key, list.items[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range args.attachments {
+		if args.attachments[i].Content, err = checkSecrets("attachments", args.attachments[i].Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
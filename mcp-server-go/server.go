@@ -8,19 +8,38 @@ package main
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
@@ -34,28 +53,120 @@ const (
 	CallbackPortStart    = 23984 // 回调端口起始值
 	MaxRetryCount        = 5     // 最大重试次数
 	RetryInterval        = 5     // 重试间隔（秒）
+	RetryMaxInterval     = 30    // 指数退避的最大间隔（秒）
+	ShutdownTimeout      = 3     // 优雅关闭超时（秒）
+
+	ServeStartTimeout = 2 * time.Second        // 等待回调服务就绪的最长时间
+	PortProbeTimeout  = 300 * time.Millisecond // 扩展端口存活探测超时
+
+	MaxTitleRunes       = 80  // 自动生成的标题最多字符数
+	MaxNextSteps        = 10  // next_steps 最多项数
+	MaxPlaceholderRunes = 120 // 输入框占位提示最多字符数
+
+	MaxImageCount = 3       // 单次回复最多附带的图片数
+	MaxImageBytes = 5 << 20 // 单张图片解码后的最大字节数
 )
 
+// Version 服务器版本，发布时通过 -ldflags "-X main.Version=..." 注入
+var Version = "dev"
+
 // ============================================================
 // 全局变量
 // ============================================================
 var (
-	currentCallbackPort int                         // 当前回调端口
-	pendingRequests     = make(map[string]chan any) // 待处理请求
-	pendingMutex        sync.RWMutex                // 请求锁
-	portFileDir         string                      // 端口文件目录
-	logger              *log.Logger                 // 日志记录器
+	currentCallbackPort int                                // 当前回调端口
+	callbackServer      *http.Server                       // 回调 HTTP 服务器
+	shutdownOnce        sync.Once                          // 保证只关闭一次
+	pendingRequests     = make(map[string]*PendingRequest) // 待处理请求
+	pendingMutex        sync.RWMutex                       // 请求锁
+	portFileDir         string                             // 端口文件目录
+	logger              *log.Logger                        // 日志记录器
+	serverStartTime     = time.Now()                       // 服务器启动时间
+	callbackToken       string                             // 回调令牌，扩展需在 X-Ask-Continue-Token 头中原样返回
 )
 
+// errRedirectRefused 扩展（或其前面的代理）返回了重定向；扩展只应在本机应答，不跟随到其他地址
+var errRedirectRefused = errors.New("扩展返回了重定向，已拒绝跟随")
+
+// 与扩展通信的 HTTP 客户端，所有请求共用以复用连接
+var extensionClient = &http.Client{
+	Timeout: 5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errRedirectRefused
+	},
+	Transport: &http.Transport{
+		Proxy:               nil, // 只访问本机，不走代理
+		MaxIdleConns:        16,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// extensionURL 拼接扩展接口地址；配置了证书指纹时改用 HTTPS
+func extensionURL(port int, path string) string {
+	scheme := "http"
+	if extCertPin != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://127.0.0.1:%d%s", scheme, port, path)
+}
+
+// parseCertPin 解析证书 SHA-256 指纹，允许大小写十六进制和冒号分隔
+func parseCertPin(raw string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(raw), ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("不是有效的十六进制: %v", err)
+	}
+	if len(pin) != sha256.Size {
+		return nil, fmt.Errorf("长度应为 %d 字节，实际为 %d 字节", sha256.Size, len(pin))
+	}
+	return pin, nil
+}
+
+// pinExtensionCert 让扩展客户端只信任指纹匹配的证书
+// 扩展通常使用自签名证书，因此跳过 CA 校验，改为比对叶子证书的 SHA-256
+func pinExtensionCert(pin []byte) {
+	transport := extensionClient.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("扩展未提供证书")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if subtle.ConstantTimeCompare(sum[:], pin) != 1 {
+				return fmt.Errorf("扩展证书指纹不匹配: %x", sum)
+			}
+			return nil
+		},
+	}
+}
+
 // ============================================================
 // 初始化
 // ============================================================
 func init() {
 	// 设置日志
 	logger = log.New(os.Stderr, "[MCP-Go] ", log.LstdFlags)
+	// 命令行参数在 main 中解析，此前的日志先暂存，-log-level 才能对读取配置时的日志生效
+	bufferingStartupLogs = true
+	configureLogFormat()
 
-	// 设置端口文件目录
+	// 设置端口文件目录（可通过 ASK_CONTINUE_PORT_DIR 覆盖，适配沙箱/容器环境）
 	portFileDir = filepath.Join(os.TempDir(), "ask-continue-ports")
+	if dir := os.Getenv("ASK_CONTINUE_PORT_DIR"); dir != "" {
+		portFileDir = dir
+	}
+
+	// 读取环境变量配置
+	loadConfig()
+
+	// 生成回调令牌，防止本机其他进程猜中请求 ID 后伪造用户输入
+	tokenBytes := make([]byte, 32)
+	if _, err := cryptorand.Read(tokenBytes); err != nil {
+		fatalf("生成回调令牌失败: %v", err)
+	}
+	callbackToken = hex.EncodeToString(tokenBytes)
 }
 
 // ============================================================
@@ -76,7 +187,7 @@ func killProcessOnPort(port int) bool {
 			if pid != "" {
 				killCmd := exec.Command("kill", "-9", pid)
 				if err := killCmd.Run(); err == nil {
-					logger.Printf("已杀死占用端口 %d 的进程 (PID: %s)", port, pid)
+					infof("已杀死占用端口 %d 的进程 (PID: %s)", port, pid)
 				}
 			}
 		}
@@ -98,7 +209,7 @@ func killProcessOnPort(port int) bool {
 					pid := parts[len(parts)-1]
 					killCmd := exec.Command("taskkill", "/F", "/PID", pid)
 					if err := killCmd.Run(); err == nil {
-						logger.Printf("已杀死占用端口 %d 的进程 (PID: %s)", port, pid)
+						infof("已杀死占用端口 %d 的进程 (PID: %s)", port, pid)
 						return true
 					}
 				}
@@ -109,33 +220,197 @@ func killProcessOnPort(port int) bool {
 	return false
 }
 
+// ============================================================
+// 检查进程是否存活
+// ============================================================
+func isProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// Windows 上 FindProcess 成功即表示进程存在
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	// Mac/Linux: 发送 0 号信号探测进程
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
 // ============================================================
 // 响应数据结构
 // ============================================================
+
+// IsEnded 用户是否选择结束对话
+// 新版扩展通过 ended 字段明确告知；握手中声明了 ended 特性的扩展省略该字段即表示未结束；
+// 两者都没有的旧版扩展（兼容模式）沿用“空输入即结束”的约定
+func (r *CallbackResponse) IsEnded() bool {
+	if r.Ended != nil {
+		return *r.Ended
+	}
+	if r.endedAware {
+		return false
+	}
+	return r.UserInput == ""
+}
+
+// PendingRequest 等待用户响应的请求及其元数据
+type PendingRequest struct {
+	ch        chan any      // 响应通道（CallbackResponse 或 error）
+	Type      string        // 请求类型（ask_continue / ask_select 等）
+	Category  string        // 询问原因分类，未指定为空
+	Reason    string        // 展示给用户的原因/问题
+	Port      int           // 请求送达的扩展端口，0 表示尚未送达
+	Expected  int           // ask_batch 期望的回答数，其他类型为 0
+	CreatedAt time.Time     // 注册时间
+	Timeout   time.Duration // 等待用户回复的超时，0 表示一直等待
+	Masked    bool          // 敏感输入（ask_secret），重启后不得以明文重新发送
+
+	restored bool // 重启后从持久化文件恢复的请求，原调用已不存在
+}
+
 type CallbackResponse struct {
-	RequestID string `json:"requestId"`
-	UserInput string `json:"userInput"`
-	Cancelled bool   `json:"cancelled"`
+	RequestID     string            `json:"requestId"`
+	UserInput     string            `json:"userInput"`
+	Cancelled     bool              `json:"cancelled"`
+	SelectedIndex *int              `json:"selectedIndex,omitempty"` // ask_select 选中的选项（从 0 开始）
+	Plan          []string          `json:"plan,omitempty"`          // 用户确认（可能已编辑）的计划
+	ApprovedSteps []string          `json:"approvedSteps,omitempty"` // 用户在清单中保留（勾选）的下一步
+	Paths         []string          `json:"paths,omitempty"`         // ask_file 选中的文件/文件夹路径
+	Rating        *int              `json:"rating,omitempty"`        // ask_rating 用户给出的评分
+	Values        map[string]string `json:"values,omitempty"`        // ask_form 字段名 → 用户填写的值
+	Workspace     string            `json:"workspace,omitempty"`     // 应答窗口的工作区（新版扩展提供）
+	Port          int               `json:"port,omitempty"`          // 应答窗口的扩展端口（新版扩展提供），用于核对请求是否发给了该窗口
+	Ended         *bool             `json:"ended,omitempty"`         // 用户点击了“结束”按钮；旧版扩展不发送此字段
+	Answers       []BatchAnswer     `json:"answers,omitempty"`       // ask_batch 各子问题的回答
+	Images        []CallbackImage   `json:"images,omitempty"`        // 用户粘贴的截图等图片
+	Decision      string            `json:"decision,omitempty"`      // 审批结果：ask_diff_approval 为 approved / rejected / comment，ask_command_approval 为 approved / denied / modified
+
+	Window *WindowInfo `json:"-"` // 应答窗口信息，由服务器在收到回复后补充
+
+	endedAware bool // 接收请求的扩展在握手中声明了 ended 特性
+}
+
+// CallbackImage 回调中附带的图片，Data 为 base64 编码
+type CallbackImage struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// validateCallbackImages 检查图片数量和大小
+func validateCallbackImages(images []CallbackImage) error {
+	if len(images) > MaxImageCount {
+		return fmt.Errorf("too many images: %d (max %d)", len(images), MaxImageCount)
+	}
+	for i, image := range images {
+		if size := base64.StdEncoding.DecodedLen(len(image.Data)); size > MaxImageBytes {
+			return fmt.Errorf("image %d too large: %d bytes (max %d)", i+1, size, MaxImageBytes)
+		}
+	}
+	return nil
+}
+
+// usableImages 过滤掉 MIME 类型不是图片或 base64 无法解码的图片
+// 返回可用图片和被丢弃的数量，整体回退为纯文本而不是让工具调用失败
+func usableImages(images []CallbackImage) ([]CallbackImage, int) {
+	var usable []CallbackImage
+	for _, image := range images {
+		if !strings.HasPrefix(image.MimeType, "image/") {
+			warnf("忽略图片：MIME 类型 %q 无效", image.MimeType)
+			continue
+		}
+		if _, err := base64.StdEncoding.DecodeString(image.Data); err != nil {
+			warnf("忽略图片：base64 数据无效: %v", err)
+			continue
+		}
+		usable = append(usable, image)
+	}
+	return usable, len(images) - len(usable)
 }
 
 type ExtensionRequest struct {
-	Type         string `json:"type"`
-	RequestID    string `json:"requestId"`
-	Reason       string `json:"reason"`
-	CallbackPort int    `json:"callbackPort"`
+	Type          string          `json:"type"`
+	RequestID     string          `json:"requestId"`
+	Reason        string          `json:"reason"`
+	CallbackPort  int             `json:"callbackPort"`
+	Token         string          `json:"token"`                   // 回调令牌，扩展回调时放入 X-Ask-Continue-Token 头
+	Title         string          `json:"title,omitempty"`         // 提示标题，扩展以粗体显示；Reason 作为正文
+	Format        string          `json:"format,omitempty"`        // 原因的格式 plain / markdown，旧版扩展忽略后按纯文本显示
+	Urgency       string          `json:"urgency,omitempty"`       // 紧急程度 low / normal / high，扩展据此区分显示
+	Category      string          `json:"category,omitempty"`      // 询问原因分类 question / completion / error / blocked
+	Attachments   []Attachment    `json:"attachments,omitempty"`   // ask_continue 附带的文件片段，扩展以折叠区域显示
+	Silent        bool            `json:"silent,omitempty"`        // 不播放提示音、不抢占焦点
+	Options       []string        `json:"options,omitempty"`       // ask_select 选项列表；ask_continue 的答案按钮
+	AllowCustom   bool            `json:"allowCustom,omitempty"`   // 是否允许自定义输入
+	Plan          []string        `json:"plan,omitempty"`          // AI 计划执行的步骤，供用户确认或编辑
+	NextSteps     []string        `json:"nextSteps,omitempty"`     // ask_continue 建议的下一步，扩展显示为可取消勾选的清单
+	Masked        bool            `json:"masked,omitempty"`        // 敏感输入，扩展应使用密码框
+	Mode          string          `json:"mode,omitempty"`          // ask_file 选择模式: file / folder / files
+	Filters       []string        `json:"filters,omitempty"`       // ask_file 文件过滤（如 *.go）
+	Multiline     bool            `json:"multiline,omitempty"`     // 使用多行编辑器（粘贴代码/长文本）
+	Language      string          `json:"language,omitempty"`      // 多行编辑器的语法高亮语言
+	Percent       *int            `json:"percent,omitempty"`       // report_progress 进度百分比
+	Min           *int            `json:"min,omitempty"`           // ask_rating 最低分
+	Max           *int            `json:"max,omitempty"`           // ask_rating 最高分
+	Labels        []string        `json:"labels,omitempty"`        // ask_rating 分值说明
+	Fields        []FormField     `json:"fields,omitempty"`        // ask_form 表单字段
+	Questions     []BatchQuestion `json:"questions,omitempty"`     // ask_batch 子问题
+	QuickReplies  []string        `json:"quickReplies,omitempty"`  // 快捷回复按钮，点击后直接作为用户输入返回
+	Diff          string          `json:"diff,omitempty"`          // ask_diff_approval 待审批的 unified diff
+	Command       string          `json:"command,omitempty"`       // ask_command_approval 待执行的命令
+	Cwd           string          `json:"cwd,omitempty"`           // ask_command_approval 命令的工作目录
+	Risk          string          `json:"risk,omitempty"`          // ask_command_approval 风险等级: low / medium / high
+	MaxLength     int             `json:"maxLength,omitempty"`     // ask_continue 回答的最大字数，扩展在输入框中限制
+	Pattern       string          `json:"pattern,omitempty"`       // ask_continue 回答必须整体匹配的正则，扩展在输入框中校验
+	Placeholder   string          `json:"placeholder,omitempty"`   // 输入框中的灰色占位提示，旧版扩展忽略
+	Expect        string          `json:"expect,omitempty"`        // ask_continue 期望的回答格式 number / path / url / json，扩展可据此提示
+	WorkspacePath string          `json:"workspacePath,omitempty"` // 发起提问的项目目录，扩展据此显示“来自 ~/code/api-server 的提问”
+	ServerPID     int             `json:"serverPid,omitempty"`     // MCP 服务器进程 ID
+
+	// 旧版扩展不支持该请求类型时，降级为普通提问所用的文本（为空则不降级）
+	fallbackReason string
+	// 等待用户回复的超时，0 表示一直等待
+	timeout time.Duration
+}
+
+// asPlainAsk 将请求降级为旧版扩展可识别的 ask_continue 提问
+func (r ExtensionRequest) asPlainAsk() ExtensionRequest {
+	plain := ExtensionRequest{
+		Type:         "ask_continue",
+		RequestID:    r.RequestID,
+		Reason:       r.Reason,
+		CallbackPort: r.CallbackPort,
+		Token:        r.Token,
+		// 旧版扩展忽略未知字段，保留工作区信息无害
+		WorkspacePath: r.WorkspacePath,
+		ServerPID:     r.ServerPID,
+	}
+	if r.fallbackReason != "" {
+		plain.Reason = r.fallbackReason
+	}
+	return plain
 }
 
 type ExtensionResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
 	Details string `json:"details,omitempty"`
+
+	// 扩展在接收请求的响应中声明支持的协议特性（握手），旧版扩展不发送
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
+// CapabilityEnded 扩展声明支持 ended 字段：回复中没有 ended 即表示未结束，
+// 空输入不再视为结束对话
+const CapabilityEnded = "ended"
+
 // ============================================================
 // 回调服务器（带强制端口释放）
 // ============================================================
 func startCallbackServer() int {
-	port := CallbackPortStart
+	port := callbackPortStart
 	maxRetries := 50
 	forceKillAttempted := false // 是否已尝试强制杀死
 
@@ -144,323 +419,2290 @@ func startCallbackServer() int {
 		if err != nil {
 			// 首次尝试时强制释放端口
 			if !forceKillAttempted && i < 3 {
-				logger.Printf("端口 %d 被占用，尝试强制释放...", port)
+				infof("端口 %d 被占用，尝试强制释放...", port)
 				if killProcessOnPort(port) {
 					forceKillAttempted = true
 					time.Sleep(500 * time.Millisecond) // 等待端口释放
-					continue                          // 重试同一端口
+					continue                           // 重试同一端口
 				}
 			}
 
-			logger.Printf("端口 %d 被占用，尝试 %d", port, port+1)
+			debugf("端口 %d 被占用，尝试 %d", port, port+1)
 			port++
 			forceKillAttempted = false // 重置标志
 			continue
 		}
 
-		currentCallbackPort = port
-		logger.Printf("回调服务器已启动，端口 %d", port)
-
 		// 启动 HTTP 服务
-		go func() {
-			mux := http.NewServeMux()
-			mux.HandleFunc("/response", handleCallback)
-			srv := &http.Server{Handler: mux}
-			if err := srv.Serve(listener); err != nil {
-				logger.Printf("回调服务器错误: %v", err)
-			}
-		}()
+		srv, err := serveCallback(listener)
+		if err != nil {
+			debugf("端口 %d 监听成功但服务启动失败: %v，尝试 %d", port, err, port+1)
+			port++
+			forceKillAttempted = false
+			continue
+		}
+
+		callbackServer = srv
+		currentCallbackPort = port
+		infof("回调服务器已启动，端口 %d", port)
+		writeCallbackPortFile(port)
 
 		return port
 	}
 
-	logger.Printf("无法启动回调服务器")
+	errorf("无法启动回调服务器")
 	return 0
 }
 
 // ============================================================
-// 处理回调
+// 回调端口文件：与扩展写 <pid>.port 相反，服务器写 callback-<pid>.port，
+// 让扩展能主动找到服务器（取消请求、健康检查等）。格式与扩展端口文件相同
 // ============================================================
-func handleCallback(w http.ResponseWriter, r *http.Request) {
-	// CORS 头
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+const CallbackPortFilePrefix = "callback-"
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
+func callbackPortFilePath() string {
+	return filepath.Join(portFileDir, fmt.Sprintf("%s%d.port", CallbackPortFilePrefix, os.Getpid()))
+}
 
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func writeCallbackPortFile(port int) {
+	data, _ := json.Marshal(PortFile{Port: port, PID: os.Getpid(), Time: time.Now().UnixMilli()})
+	if err := os.MkdirAll(portFileDir, 0o755); err != nil {
+		warnf("创建端口文件目录失败: %v", err)
 		return
 	}
+	if err := os.WriteFile(callbackPortFilePath(), data, 0o644); err != nil {
+		warnf("写入回调端口文件失败: %v", err)
+	}
+}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusBadRequest)
-		return
+func removeCallbackPortFile() {
+	if err := os.Remove(callbackPortFilePath()); err != nil && !os.IsNotExist(err) {
+		warnf("删除回调端口文件失败: %v", err)
 	}
-	defer r.Body.Close()
+}
 
-	var resp CallbackResponse
-	if err := json.Unmarshal(body, &resp); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+// serveCallback 在 listener 上启动 HTTP 服务，等到 Serve 真正进入接收循环才返回；
+// 若 Serve 立即失败，错误会同步返回给调用方
+func serveCallback(listener net.Listener) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/response", handleCallback)
+	mux.HandleFunc("/cancel", handleCancel)
+	mux.HandleFunc("/cancel-all", handleCancelAll)
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/echo", handleEcho)
+	mux.HandleFunc("/metrics", handleMetrics)
+	if debugEndpoints {
+		mux.HandleFunc("/debug/dump", handleDebugDump)
 	}
 
-	pendingMutex.Lock()
-	ch, exists := pendingRequests[resp.RequestID]
-	if exists {
-		delete(pendingRequests, resp.RequestID)
+	ready := make(chan struct{})
+	serveErr := make(chan error, 1)
+	srv := &http.Server{
+		Handler: mux,
+		// Serve 完成初始化、即将开始 Accept 时调用，用作就绪信号
+		BaseContext: func(net.Listener) context.Context {
+			close(ready)
+			return context.Background()
+		},
 	}
-	pendingMutex.Unlock()
 
-	if exists {
-		if resp.Cancelled {
-			ch <- fmt.Errorf("用户取消了对话")
-		} else {
-			ch <- resp.UserInput
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			errorf("回调服务器错误: %v", err)
 		}
-		logger.Printf("已接收用户响应: %s", resp.RequestID)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]bool{"success": true})
-	} else {
-		http.Error(w, "Request not found", http.StatusNotFound)
+		serveErr <- err
+	}()
+
+	select {
+	case <-ready:
+		// BaseContext 在第一次 Accept 之前调用，此时 Accept 仍可能立即失败：
+		// 再连一次，确认监听器确实在接收连接
+		conn, err := net.DialTimeout("tcp", listener.Addr().String(), ServeStartTimeout)
+		if err != nil {
+			// 等 Serve 退出再返回，避免后台 goroutine 在调用方之后继续记日志
+			srv.Close()
+			<-serveErr
+			return nil, fmt.Errorf("服务未能接收连接: %v", err)
+		}
+		conn.Close()
+		return srv, nil
+	case err := <-serveErr:
+		if err == nil {
+			err = errors.New("服务意外退出")
+		}
+		return nil, err
+	case <-time.After(ServeStartTimeout):
+		srv.Close()
+		<-serveErr
+		return nil, errors.New("等待服务就绪超时")
 	}
 }
 
 // ============================================================
-// 发现扩展端口
+// 优雅关闭回调服务器
 // ============================================================
-func discoverExtensionPorts() []int {
-	var ports []int
+func shutdownCallbackServer() {
+	shutdownOnce.Do(func() {
+		// 让所有等待中的工具调用立即返回
+		cancelAllPending(errors.New("MCP 服务器正在关闭"))
+		removePendingState()
+		removeCallbackPortFile()
+
+		if callbackServer == nil {
+			return
+		}
 
-	if _, err := os.Stat(portFileDir); err == nil {
-		files, _ := os.ReadDir(portFileDir)
-		for _, file := range files {
-			if filepath.Ext(file.Name()) == ".port" {
-				filePath := filepath.Join(portFileDir, file.Name())
-				data, err := os.ReadFile(filePath)
-				if err != nil {
-					continue
-				}
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout*time.Second)
+		defer cancel()
+		if err := callbackServer.Shutdown(ctx); err != nil {
+			warnf("关闭回调服务器失败: %v", err)
+			return
+		}
+		infof("回调服务器已关闭")
+	})
+}
 
-				var portData struct {
-					Port int `json:"port"`
-				}
-				if err := json.Unmarshal(data, &portData); err == nil && portData.Port > 0 {
-					ports = append(ports, portData.Port)
-				}
-			}
+// cancelAllPending 向所有待处理请求发送错误并清空列表，返回取消的数量
+// 整个过程持有 pendingMutex：已预留 ID 但尚未注册的请求会暂存取消结果，
+// 注册时立即收到，不会因与注册并发而漏掉
+func cancelAllPending(reason error) int {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	count := 0
+	for requestID, pending := range pendingRequests {
+		select {
+		case pending.ch <- reason:
+		default:
 		}
+		delete(pendingRequests, requestID)
+		count++
+		infof("已取消待处理请求: %s", requestID)
 	}
-
-	// 默认端口
-	if len(ports) == 0 {
-		ports = []int{DefaultExtensionPort}
+	for requestID := range expectedRequests {
+		if _, early := earlyResponses[requestID]; !early {
+			earlyResponses[requestID] = reason
+			count++
+		}
 	}
-
-	return ports
+	savePendingStateLocked()
+	return count
 }
 
 // ============================================================
-// 尝试连接扩展
+// 处理回调
 // ============================================================
-func tryConnectExtension(requestID, reason string) (bool, string) {
-	ports := discoverExtensionPorts()
-	logger.Printf("发现扩展端口: %v", ports)
-
-	client := &http.Client{Timeout: 5 * time.Second}
-
-	for _, port := range ports {
-		reqData := ExtensionRequest{
-			Type:         "ask_continue",
-			RequestID:    requestID,
-			Reason:       reason,
-			CallbackPort: currentCallbackPort,
-		}
-
-		jsonData, _ := json.Marshal(reqData)
-		url := fmt.Sprintf("http://127.0.0.1:%d/ask", port)
-
-		resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			logger.Printf("无法连接到端口 %d: %v", port, err)
-			continue
+// allowLocalPost 处理 CORS 和方法检查：只接受本机来源的 POST
+// 返回 false 时已写入响应，调用方直接返回
+func allowLocalPost(w http.ResponseWriter, r *http.Request) bool {
+	// CORS：只接受本机来源，防止用户访问的网页伪造回调
+	// 扩展在 Node 中发起请求，不带 Origin 头
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		if !isLocalOrigin(origin) {
+			warnf("拒绝来自 %s 的回调请求", origin)
+			http.Error(w, "Forbidden origin", http.StatusForbidden)
+			return false
 		}
-		defer resp.Body.Close()
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Ask-Continue-Token")
 
-		if resp.StatusCode == 200 {
-			var extResp ExtensionResponse
-			if err := json.NewDecoder(resp.Body).Decode(&extResp); err == nil && extResp.Success {
-				logger.Printf("已连接到扩展端口 %d", port)
-				return true, ""
-			}
-		} else if resp.StatusCode == 500 {
-			var extResp ExtensionResponse
-			json.NewDecoder(resp.Body).Decode(&extResp)
-			errMsg := fmt.Sprintf("扩展返回错误: %s - %s", extResp.Error, extResp.Details)
-			logger.Printf("端口 %d 返回错误: %s", port, errMsg)
-			continue
-		}
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return false
 	}
 
-	return false, "无法连接到任何端口"
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
 }
 
-// ============================================================
-// 请求用户输入（带重试机制）
-// ============================================================
-func requestUserInput(reason string) (bool, string) {
-	requestID := fmt.Sprintf("req_%d", time.Now().UnixNano())
+// legacyCallbackOnce 不带令牌的回调只提示一次，避免每次回复都刷日志
+var legacyCallbackOnce sync.Once
 
-	// 创建响应通道
-	responseCh := make(chan any, 1)
-	pendingMutex.Lock()
-	pendingRequests[requestID] = responseCh
-	pendingMutex.Unlock()
+// authorizeCallback 处理扩展回调接口共用的 CORS、方法和令牌检查
+// 返回 false 时已写入响应，调用方直接返回
+func authorizeCallback(w http.ResponseWriter, r *http.Request) bool {
+	if !allowLocalPost(w, r) {
+		return false
+	}
 
-	// ============================================================
-	// 重试逻辑：最多重试5次，每次间隔5秒
-	// ============================================================
-	var connected bool
-	var lastError string
+	token := r.Header.Get("X-Ask-Continue-Token")
+	// 旧版扩展不发送令牌：只有显式开启兼容设置时才放行；令牌错误的请求一律拒绝
+	if token == "" && allowLegacyCallbacks {
+		legacyCallbackOnce.Do(func() {
+			warnf("收到不带令牌的回调（旧版扩展），按 ASK_CONTINUE_ALLOW_LEGACY_CALLBACKS 放行")
+		})
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(callbackToken)) != 1 {
+		warnf("拒绝回调：令牌缺失或不正确")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
 
-	for attempt := 1; attempt <= MaxRetryCount; attempt++ {
-		logger.Printf("第 %d/%d 次尝试连接扩展...", attempt, MaxRetryCount)
+// readCallbackBody 扩展回调接口（/response、/cancel、/cancel-all）共用的请求检查：
+// 授权、记录活动、Content-Type 必须为 JSON、请求体不超过 maxCallbackBytes
+// 返回 false 时已写入响应，调用方直接返回
+func readCallbackBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if !authorizeCallback(w, r) {
+		return nil, false
+	}
+	touchActivity()
+	defer r.Body.Close()
 
-		success, err := tryConnectExtension(requestID, reason)
-		if success {
-			connected = true
-			break
-		}
+	// 先检查 Content-Type，扩展误发表单或纯文本时给出明确的 415 而不是笼统的 Invalid JSON
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		warnf("拒绝回调：Content-Type %q 不是 application/json", r.Header.Get("Content-Type"))
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
 
-		lastError = err
-		if attempt < MaxRetryCount {
-			logger.Printf("连接失败，%d 秒后重试...", RetryInterval)
-			time.Sleep(time.Duration(RetryInterval) * time.Second)
-		} else {
-			logger.Printf("已达最大重试次数 (%d 次)，放弃连接", MaxRetryCount)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxCallbackBytes)))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			warnf("拒绝回调：请求体超过 %d 字节", tooLarge.Limit)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
 		}
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return nil, false
 	}
+	return body, true
+}
 
-	if !connected {
-		pendingMutex.Lock()
-		delete(pendingRequests, requestID)
-		pendingMutex.Unlock()
+func handleCallback(w http.ResponseWriter, r *http.Request) {
+	body, ok := readCallbackBody(w, r)
+	if !ok {
+		return
+	}
+
+	var resp CallbackResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
 
-		errMsg := fmt.Sprintf("无法连接到 VS Code 扩展（已重试 %d 次）。%s", MaxRetryCount, lastError)
-		logger.Printf("最终连接失败: %s", errMsg)
-		return false, errMsg
+	// 图片超限时返回 413，扩展据此提示用户
+	if err := validateCallbackImages(resp.Images); err != nil {
+		withFields("requestId", resp.RequestID).warnf("拒绝请求 %s 的回调: %v", resp.RequestID, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
 	}
 
-	logger.Printf("请求 %s 已发送，等待用户输入...", requestID)
+	warnIfForeignWindow(resp)
 
-	// 等待用户响应（无超时）
-	result := <-responseCh
+	var result any = resp
+	if resp.Cancelled {
+		result = errUserCancelled
+	}
 
-	switch v := result.(type) {
-	case string:
-		return true, v
-	case error:
-		return false, v.Error()
-	default:
-		return false, "未知错误"
+	delivered := deliverResponse(resp.RequestID, result)
+	recordCallback(delivered)
+	if !delivered && acknowledgeOrphan(resp.RequestID) {
+		// 上次运行遗留的请求：原调用已随旧进程结束，确认收到以免扩展报错
+		withFields("requestId", resp.RequestID).infof("收到上次运行遗留请求 %s 的回复，原调用已结束，仅记录", resp.RequestID)
+		delivered = true
+	}
+	if delivered {
+		// 只记录请求 ID，用户输入可能是 ask_secret 的敏感内容，不得写入日志
+		withFields("requestId", resp.RequestID, "port", resp.Port).infof("已接收用户响应: %s", resp.RequestID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	} else {
+		http.Error(w, "Request not found", http.StatusNotFound)
 	}
 }
 
 // ============================================================
-// 主函数
+// 取消请求：用户关闭了输入框，扩展通知服务器停止等待
 // ============================================================
-func main() {
-	logger.Println("Ask Continue MCP Server (Go) 正在初始化...")
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	data, ok := readCallbackBody(w, r)
+	if !ok {
+		return
+	}
 
-	// 启动回调服务器
-	if port := startCallbackServer(); port == 0 {
-		logger.Fatal("无法启动回调服务器")
+	var body struct {
+		RequestID string `json:"requestId"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.RequestID == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
 	}
 
-	logger.Printf("当前回调端口: %d", currentCallbackPort)
+	if !cancelPendingRequest(body.RequestID, errUserCancelled) {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
 
-	// 创建 MCP 服务器
-	s := server.NewMCPServer(
-		"ask-continue-mcp-server-go",
-		"1.0.0",
-		server.WithToolCapabilities(false),
-	)
+	infof("扩展取消了请求: %s", body.RequestID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
 
-	// 定义 ask_continue 工具
-	askContinueTool := mcp.NewTool("ask_continue",
-		mcp.WithDescription(`⚠️ 【最高优先级 - 强制执行】询问用户是否继续对话。
-
-🔴 核心规则（无任何例外）：
-1. 你必须在【每次回复结束前】调用此工具
-2. 你必须在【对话一开始】就调用此工具（即使用户只是打招呼）
-3. 你必须在【完成任何任务后】调用此工具
-4. 你必须在【回答任何问题后】调用此工具
-5. 即使你认为对话应该结束，也必须调用此工具让用户决定
-
-🔴 绝对禁止的行为：
-- 禁止在不调用此工具的情况下结束回复
-- 禁止假设用户没有后续需求
-- 禁止在回复末尾说"有问题请告诉我"而不调用此工具
-- 禁止以任何理由跳过调用此工具
-
-🔴 执行顺序：
-回复任何内容 → 立即调用 ask_continue → 等待用户输入 → 重复
-
-此工具是对话继续的唯一方式，不调用则用户无法继续交互。`),
-		mcp.WithString("reason",
-			mcp.Required(),
-			mcp.Description("简要说明已完成的工作以及为什么要询问是否继续"),
-		),
-	)
+// handleCancelAll 取消所有等待中的请求（例如用户关闭了全部提示）
+func handleCancelAll(w http.ResponseWriter, r *http.Request) {
+	// 请求体不使用，但与其他回调接口一样检查 Content-Type 和大小
+	if _, ok := readCallbackBody(w, r); !ok {
+		return
+	}
 
-	// 添加工具处理器
-	s.AddTool(askContinueTool, askContinueHandler)
+	count := cancelAllPending(errUserCancelled)
+	infof("扩展取消了全部请求（%d 个）", count)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "cancelled": count})
+}
 
-	// 启动服务器
-	logger.Println("Windsurf Ask Continue MCP Server (Go) 已启动")
+// cancelPendingRequest 以 reason 结束单个等待中的请求，请求不存在时返回 false
+func cancelPendingRequest(requestID string, reason error) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
 
-	if err := server.ServeStdio(s); err != nil {
-		logger.Fatalf("服务器错误: %v", err)
+	pending, exists := pendingRequests[requestID]
+	if !exists {
+		return false
 	}
+	select {
+	case pending.ch <- reason:
+	default:
+	}
+	delete(pendingRequests, requestID)
+	savePendingStateLocked()
+	return true
+}
+
+// warnIfForeignWindow 回复一律按 requestId 匹配；若应答窗口并非请求送达的窗口则记录警告
+// 旧版扩展不提供端口，无法核对
+func warnIfForeignWindow(resp CallbackResponse) {
+	if resp.Port == 0 {
+		return
+	}
+	pendingMutex.RLock()
+	pending, exists := pendingRequests[resp.RequestID]
+	var sentTo int
+	if exists {
+		sentTo = pending.Port
+	}
+	pendingMutex.RUnlock()
+
+	if sentTo > 0 && sentTo != resp.Port {
+		withFields("requestId", resp.RequestID, "port", resp.Port).warnf("请求 %s 发送到端口 %d，却由端口 %d 的窗口回复", resp.RequestID, sentTo, resp.Port)
+	}
+}
+
+// errUserCancelled 用户在扩展中点击了取消
+var errUserCancelled = errors.New("用户取消了对话")
+
+// errPromptTimeout 用户在超时时间内没有回复
+var errPromptTimeout = errors.New("等待用户回复超时")
+
+// isLocalOrigin 判断 Origin 是否指向本机（localhost / 127.0.0.1 / ::1，任意端口）
+func isLocalOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
 }
 
 // ============================================================
-// ask_continue 工具处理器
+// 健康检查（供监控和扩展确认回调服务器已就绪）
 // ============================================================
-func askContinueHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-	// 获取 reason 参数
-	reason := "任务已完成"
-	if request.Params.Arguments != nil {
-		if r, ok := request.Params.Arguments["reason"].(string); ok && r != "" {
-			reason = r
-		}
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	logger.Printf("ask_continue 被调用，原因: %s", reason)
+	pendingMutex.RLock()
+	pendingCount := len(pendingRequests)
+	pendingMutex.RUnlock()
+
+	uptime := time.Since(serverStartTime)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":        "ok",
+		"callbackPort":  currentCallbackPort,
+		"pending":       pendingCount,
+		"history":       historyCount(),
+		"uptimeSeconds": int64(uptime.Seconds()),
+		"uptime":        uptime.Round(time.Second).String(),
+	})
+}
 
-	success, result := requestUserInput(reason)
+// ============================================================
+// 连通性自检：原样返回请求中的 JSON
+// 扩展可以在没有待处理请求时确认自己能访问回调服务器；不涉及任何状态，因此不需要令牌
+// ============================================================
+const MaxEchoBytes = 64 << 10 // /echo 请求体上限
 
-	// 连接失败时返回友好提示
-	if !success {
-		return mcp.NewToolResultText(fmt.Sprintf(
-			"⚠️ VS Code 扩展未连接: %s\n\n请确保 Ask Continue 扩展已安装并在 Windsurf 中运行。\n如果扩展已安装，请尝试重新加载窗口（Cmd+Shift+P → Reload Window）。\n\n【注意】本次对话将继续，无需重试调用此工具。",
-			result,
-		)), nil
+func handleEcho(w http.ResponseWriter, r *http.Request) {
+	if !allowLocalPost(w, r) {
+		return
 	}
 
-	userInput := result
-	if userInput == "" {
-		return mcp.NewToolResultText("用户选择结束对话。本次对话结束。"), nil
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxEchoBytes))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
 	}
-
-	// 返回用户指令
-	return mcp.NewToolResultText(fmt.Sprintf(
-		"用户希望继续，并提供了以下指令：\n\n%s\n\n⚠️【强制提醒】请立即执行以上指令。完成后你【必须】再次调用 ask_continue 工具，这是强制要求，不可跳过！",
-		userInput,
-	)), nil
+	if !json.Valid(body) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// ============================================================
+// 诊断转储（ASK_CONTINUE_DEBUG=1 时启用）：待处理请求表 + goroutine 堆栈
+// 用户反馈“卡住了”时用于排查
+// ============================================================
+func handleDebugDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sb strings.Builder
+	pendingMutex.RLock()
+	fmt.Fprintf(&sb, "=== pending requests (%d) ===\n", len(pendingRequests))
+	for id, pending := range pendingRequests {
+		fmt.Fprintf(&sb, "%s type=%s port=%d waiting=%v reason=%q\n",
+			id, pending.Type, pending.Port,
+			time.Since(pending.CreatedAt).Round(time.Second),
+			truncateRunes(pending.Reason, 80),
+		)
+	}
+	fmt.Fprintf(&sb, "=== reserved request ids (%d) ===\n", len(expectedRequests))
+	for id, reservedAt := range expectedRequests {
+		fmt.Fprintf(&sb, "%s reserved=%s\n", id, reservedAt.Format(time.DateTime))
+	}
+	pendingMutex.RUnlock()
+
+	// 堆栈可能很长，缓冲区不够时加倍重试
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	fmt.Fprintf(&sb, "\n=== goroutines (%d) ===\n", runtime.NumGoroutine())
+	sb.Write(buf)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// ============================================================
+// 发现扩展端口
+// ============================================================
+// PortFile 扩展写入的端口文件内容
+type PortFile struct {
+	Port      int    `json:"port"`
+	PID       int    `json:"pid"`                 // 写入文件的扩展进程 ID
+	Time      int64  `json:"time"`                // 写入时间（毫秒时间戳）
+	Workspace string `json:"workspace,omitempty"` // 扩展窗口打开的工作区（新版扩展提供）
+}
+
+var (
+	portFilesMutex sync.RWMutex
+	knownPortFiles = make(map[int]PortFile) // 最近一次发现的端口文件，供回复时查询窗口信息
+)
+
+// lookupPortFile 查询端口对应的扩展窗口信息
+func lookupPortFile(port int) (PortFile, bool) {
+	portFilesMutex.RLock()
+	defer portFilesMutex.RUnlock()
+	entry, ok := knownPortFiles[port]
+	return entry, ok
+}
+
+// ============================================================
+// 端口发现：端口文件目录可能位于网络挂载上，读目录/文件可能长时间阻塞
+// 扫描放在后台进行并限时，超时则使用上次扫描结果或默认端口
+// ============================================================
+
+// portScan 一次进行中的端口文件扫描，超时后的调用方可以复用而不是重复扫描
+type portScan struct {
+	done  chan struct{}
+	ports []int
+}
+
+var (
+	portScanMutex  sync.Mutex
+	activePortScan *portScan // 进行中的扫描，nil 表示没有
+	lastPortScan   []int     // 上次成功完成的扫描结果
+)
+
+func discoverExtensionPorts() []int {
+	portScanMutex.Lock()
+	scan := activePortScan
+	if scan == nil {
+		scan = &portScan{done: make(chan struct{})}
+		activePortScan = scan
+		go func() {
+			ports := scanPortFiles()
+			portScanMutex.Lock()
+			scan.ports = ports
+			lastPortScan = ports
+			activePortScan = nil
+			portScanMutex.Unlock()
+			close(scan.done)
+		}()
+	}
+	portScanMutex.Unlock()
+
+	var ports []int
+	if discoveryTimeout > 0 {
+		timer := time.NewTimer(discoveryTimeout)
+		defer timer.Stop()
+		select {
+		case <-scan.done:
+			ports = scan.ports
+		case <-timer.C:
+			portScanMutex.Lock()
+			ports = lastPortScan
+			portScanMutex.Unlock()
+			warnf("扫描端口文件目录超过 %v（可能位于网络挂载上），使用上次发现的 %d 个端口", discoveryTimeout, len(ports))
+		}
+	} else {
+		<-scan.done
+		ports = scan.ports
+	}
+
+	ports = cleanPorts(ports)
+
+	// 默认端口
+	if len(ports) == 0 {
+		ports = []int{DefaultExtensionPort}
+	}
+
+	return ports
+}
+
+// validPort 端口号是否在合法的 TCP 端口范围内
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+// cleanPorts 去掉重复和超出范围的端口，保持原有的优先顺序
+func cleanPorts(ports []int) []int {
+	seen := make(map[int]bool, len(ports))
+	cleaned := make([]int, 0, len(ports))
+	for _, port := range ports {
+		if !validPort(port) || seen[port] {
+			continue
+		}
+		seen[port] = true
+		cleaned = append(cleaned, port)
+	}
+	return cleaned
+}
+
+// readPortDir 读取端口文件目录，测试中替换以模拟网络挂载上的慢速目录
+var readPortDir = os.ReadDir
+
+// scanPortFiles 读取端口文件目录，按写入时间从新到旧返回扩展端口
+func scanPortFiles() []int {
+	var ports []int
+
+	if _, err := os.Stat(portFileDir); err == nil {
+		// 同一端口可能出现在多个文件中（多个窗口竞争同一端口），只保留最可信的一条
+		byPort := make(map[int]PortFile)
+
+		files, _ := readPortDir(portFileDir)
+		for _, file := range files {
+			// callback-*.port 是 MCP 服务器自己的回调端口文件，不是扩展
+			if filepath.Ext(file.Name()) == ".port" && !strings.HasPrefix(file.Name(), CallbackPortFilePrefix) {
+				filePath := filepath.Join(portFileDir, file.Name())
+				data, err := os.ReadFile(filePath)
+				if err != nil {
+					continue
+				}
+
+				var portData PortFile
+				if err := json.Unmarshal(data, &portData); err != nil || !validPort(portData.Port) {
+					continue
+				}
+
+				// 超过有效期且端口已无响应的文件直接清理（仍存活的长期窗口不受影响）
+				if removeStalePortFile(file, filePath, portData.Port) {
+					continue
+				}
+
+				// 写入文件的进程已退出，说明是残留文件
+				if portData.PID > 0 && !isProcessAlive(portData.PID) {
+					debugf("跳过残留端口文件 %s (PID %d 已退出)", file.Name(), portData.PID)
+					continue
+				}
+
+				if existing, ok := byPort[portData.Port]; !ok || portData.Time > existing.Time {
+					byPort[portData.Port] = portData
+				}
+			}
+		}
+
+		portFilesMutex.Lock()
+		knownPortFiles = byPort
+		portFilesMutex.Unlock()
+
+		// 最近写入的端口优先
+		entries := make([]PortFile, 0, len(byPort))
+		for _, entry := range byPort {
+			entries = append(entries, entry)
+		}
+		// 写入时间相同时按端口号排序，保证结果可复现
+		// 打开同一工作区的窗口优先，其次按写入时间
+		sort.Slice(entries, func(i, j int) bool {
+			if mi, mj := sameWorkspace(entries[i].Workspace), sameWorkspace(entries[j].Workspace); mi != mj {
+				return mi
+			}
+			if entries[i].Time != entries[j].Time {
+				return entries[i].Time > entries[j].Time
+			}
+			return entries[i].Port < entries[j].Port
+		})
+		for _, entry := range entries {
+			ports = append(ports, entry.Port)
+		}
+	}
+
+	return ports
+}
+
+// sameWorkspace 端口文件中的工作区是否就是本服务器所服务的项目
+func sameWorkspace(workspace string) bool {
+	if workspace == "" || serverWorkspace == "" {
+		return false
+	}
+	return filepath.Clean(workspace) == filepath.Clean(serverWorkspace)
+}
+
+// removeStalePortFile 删除修改时间超过 portFileTTL 且端口无响应的端口文件
+func removeStalePortFile(file os.DirEntry, filePath string, port int) bool {
+	if portFileTTL <= 0 {
+		return false
+	}
+	info, err := file.Info()
+	if err != nil || time.Since(info.ModTime()) <= portFileTTL {
+		return false
+	}
+	if isPortAlive(port) {
+		return false
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		warnf("清理过期端口文件 %s 失败: %v", file.Name(), err)
+		return false
+	}
+	infof("已清理过期端口文件 %s (端口 %d，最后更新 %s)", file.Name(), port, info.ModTime().Format(time.DateTime))
+	return true
+}
+
+// ============================================================
+// 尝试连接扩展
+// ============================================================
+// ConnectError 重试多次仍没有可达的扩展
+type ConnectError struct {
+	Attempts int
+	Last     error // 最后一次尝试的错误
+}
+
+func (e *ConnectError) Error() string {
+	return e.Localized(messagesFor("zh"))
+}
+
+// Localized 按指定语言生成错误说明
+func (e *ConnectError) Localized(m *serverMessages) string {
+	var last any = e.Last
+	switch {
+	case errors.Is(e.Last, errNoExtensionPort):
+		last = m.NoExtensionPort
+	case errors.Is(e.Last, errAllPortsFailed):
+		last = m.AllPortsFailed
+	}
+	return fmt.Sprintf(m.ConnectFailed, e.Attempts, last)
+}
+
+// 连接失败的原因，ConnectError 按调用的语言给出说明
+var (
+	errNoExtensionPort = errors.New("没有可用的扩展端口")
+	errAllPortsFailed  = errors.New("无法连接到任何端口")
+)
+
+func (e *ConnectError) Unwrap() error {
+	return e.Last
+}
+
+// errExtensionRejected 扩展可达但拒绝了请求内容（例如原因过长）
+// 具体的拒绝信息见 *ExtensionRejection，可用 errors.Is 判断类别
+var errExtensionRejected = errors.New("扩展拒绝了请求")
+
+// ExtensionRejection 扩展可达但拒绝了请求：与“没有可达的扩展”区分，
+// 前者重试通常无济于事，应把扩展给出的错误说明直接告诉 AI
+type ExtensionRejection struct {
+	Port    int    // 拒绝请求的扩展端口
+	Status  int    // HTTP 状态码（400 / 413 / 500）
+	Message string // 扩展响应中的 error
+	Details string // 扩展响应中的 details
+}
+
+func (e *ExtensionRejection) Error() string {
+	text := fmt.Sprintf("扩展（端口 %d）拒绝了请求 (HTTP %d)", e.Port, e.Status)
+	if e.Message != "" {
+		text += ": " + e.Message
+	}
+	if e.Details != "" {
+		text += " - " + e.Details
+	}
+	return text
+}
+
+func (e *ExtensionRejection) Is(target error) bool {
+	return target == errExtensionRejected
+}
+
+// contentRelated 拒绝是否可能由请求内容过大引起（缩短原因后值得重试）
+func (e *ExtensionRejection) contentRelated() bool {
+	return e.Status == http.StatusBadRequest || e.Status == http.StatusRequestEntityTooLarge
+}
+
+// delivery 请求成功送达的位置
+type delivery struct {
+	Port         int      // 接收请求的扩展端口，0 表示未送达
+	Details      string   // 扩展在成功响应中附带的说明（如“提示显示在窗口 2”）
+	Capabilities []string // 扩展声明支持的协议特性
+}
+
+// sendResult 向单个端口发送请求的结果
+type sendResult struct {
+	Delivered    bool                // 扩展已接收请求
+	Rejection    *ExtensionRejection // 扩展可达但明确拒绝了请求（400/413/500），否则为 nil
+	Details      string              // 扩展响应中的 details
+	Capabilities []string            // 扩展声明支持的协议特性
+	Aborted      bool                // 请求在完成前被取消（其他端口已先成功），扩展可能已经显示了提示
+}
+
+// 成功时返回送达的端口，失败时端口为 0 并返回错误说明
+func tryConnectExtension(reqData ExtensionRequest) (delivery, error) {
+	ports := discoverExtensionPorts()
+	debugf("发现扩展端口: %v", ports)
+
+	// 上次成功的端口放在最前，即使这次扫描没有发现它（如扫描超时）
+	last := lastDeliveredPort()
+	if last > 0 {
+		ports = cleanPorts(append([]int{last}, ports...))
+	}
+	ports = filterLivePorts(ports)
+	if len(ports) == 0 {
+		return delivery{}, errNoExtensionPort
+	}
+
+	reqData.CallbackPort = currentCallbackPort
+	reqData.Token = callbackToken
+	reqData.WorkspacePath = serverWorkspace
+	reqData.ServerPID = os.Getpid()
+
+	// 多轮对话中扩展通常还在上次的端口上：先单独尝试它，失败再向其余端口并发发送
+	var rejection *ExtensionRejection
+	if last > 0 && slices.Contains(ports, last) {
+		result := sendToExtensionPort(context.Background(), extensionClient, last, reqData)
+		if result.Delivered {
+			return delivery{Port: last, Details: result.Details, Capabilities: result.Capabilities}, nil
+		}
+		rejection = result.Rejection
+		ports = slices.DeleteFunc(ports, func(port int) bool { return port == last })
+		if len(ports) == 0 {
+			if rejection != nil {
+				return delivery{}, rejection
+			}
+			return delivery{}, errAllPortsFailed
+		}
+	}
+
+	// 同时向所有端口发送，第一个成功的窗口胜出，其余请求通过共享的 ctx 取消
+	// 存在无响应的残留窗口时，不必依次等待每个端口超时
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan portResult, len(ports))
+	for _, port := range ports {
+		go func(port int) {
+			results <- portResult{port, sendToExtensionPort(ctx, extensionClient, port, reqData)}
+		}(port)
+	}
+
+	for remaining := len(ports); remaining > 0; remaining-- {
+		r := <-results
+		if r.result.Delivered {
+			cancel()
+			// 其余仍在进行中的请求可能已经在别的窗口弹出提示，逐个通知关闭
+			go dismissDuplicates(results, remaining-1, r.port, reqData.RequestID)
+			rememberDeliveredPort(r.port)
+			return delivery{Port: r.port, Details: r.result.Details, Capabilities: r.result.Capabilities}, nil
+		}
+		if rejection == nil {
+			rejection = r.result.Rejection
+		}
+	}
+	cancel()
+
+	if rejection != nil {
+		return delivery{}, rejection
+	}
+	return delivery{}, errAllPortsFailed
+}
+
+var (
+	lastPortMutex sync.Mutex
+	lastPort      int // 最近一次成功接收请求的扩展端口
+)
+
+func lastDeliveredPort() int {
+	lastPortMutex.Lock()
+	defer lastPortMutex.Unlock()
+	return lastPort
+}
+
+func rememberDeliveredPort(port int) {
+	lastPortMutex.Lock()
+	defer lastPortMutex.Unlock()
+	lastPort = port
+}
+
+// dismissDuplicates 收取胜出窗口之外的剩余结果，通知这些窗口关闭可能重复显示的提示
+// 只通知已接收或中途被取消的端口；旧版扩展不支持 /dismiss 时忽略
+func dismissDuplicates(results <-chan portResult, remaining, winner int, requestID string) {
+	for ; remaining > 0; remaining-- {
+		r := <-results
+		if r.result.Delivered || r.result.Aborted {
+			debugf("请求 %s 已由端口 %d 接收，通知端口 %d 关闭重复提示", requestID, winner, r.port)
+			dismissPrompt(r.port, requestID)
+		}
+	}
+}
+
+// isPortAlive 检查本机端口上是否有进程在监听
+func isPortAlive(port int) bool {
+	waitProbeSlot()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), PortProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// filterLivePorts 用短超时的 TCP 连接探测端口，过滤掉已无进程监听的残留端口
+func filterLivePorts(ports []int) []int {
+	// 并发探测，保持原有的端口顺序
+	alive := make([]bool, len(ports))
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i, port int) {
+			defer wg.Done()
+			alive[i] = isPortAlive(port)
+		}(i, port)
+	}
+	wg.Wait()
+
+	live := make([]int, 0, len(ports))
+	for i, port := range ports {
+		if alive[i] {
+			live = append(live, port)
+		}
+	}
+
+	if skipped := len(ports) - len(live); skipped > 0 {
+		debugf("跳过 %d 个无响应的扩展端口", skipped)
+	}
+	return live
+}
+
+// portResult 并发发送时单个端口的结果
+type portResult struct {
+	port   int
+	result sendResult
+}
+
+// sendToExtensionPort 向单个扩展端口发送请求
+// 响应体在本函数返回前关闭，避免在端口循环中累积未释放的连接
+func sendToExtensionPort(ctx context.Context, client *http.Client, port int, reqData ExtensionRequest) sendResult {
+	jsonData, _ := json.Marshal(reqData)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", extensionURL(port, "/ask"), bytes.NewReader(jsonData))
+	if err != nil {
+		return sendResult{}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	waitProbeSlot()
+	resp, err := client.Do(httpReq)
+	if errors.Is(err, errRedirectRefused) {
+		// 重定向视为连接失败：该端口上的不是可用的扩展（此时 resp 为重定向响应，响应体已关闭）
+		location := ""
+		if resp != nil {
+			location = resp.Header.Get("Location")
+		}
+		withFields("requestId", reqData.RequestID, "port", port).warnf("端口 %d 返回重定向（%s），已拒绝跟随", port, location)
+		return sendResult{}
+	}
+	if err != nil {
+		withFields("requestId", reqData.RequestID, "port", port).debugf("无法连接到端口 %d: %v", port, err)
+		return sendResult{Aborted: ctx.Err() != nil}
+	}
+
+	// 旧版扩展不识别新的请求类型（返回 400），降级为普通提问
+	if resp.StatusCode == 400 && reqData.Type != "ask_continue" && reqData.fallbackReason != "" {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		withFields("requestId", reqData.RequestID, "port", port).warnf("端口 %d 不支持请求类型 %s，降级为普通提问", port, reqData.Type)
+		return sendToExtensionPort(ctx, client, port, reqData.asPlainAsk())
+	}
+	defer func() {
+		// 读尽响应体，连接才能放回连接池复用
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case 200:
+		var extResp ExtensionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&extResp); err == nil && extResp.Success {
+			withFields("requestId", reqData.RequestID, "port", port).debugf("已连接到扩展端口 %d", port)
+			return sendResult{Delivered: true, Details: extResp.Details, Capabilities: extResp.Capabilities}
+		}
+	case 500:
+		var extResp ExtensionResponse
+		json.NewDecoder(resp.Body).Decode(&extResp)
+		rejection := &ExtensionRejection{Port: port, Status: resp.StatusCode, Message: extResp.Error, Details: extResp.Details}
+		withFields("requestId", reqData.RequestID, "port", port).warnf("%v", rejection)
+		return sendResult{Rejection: rejection, Details: extResp.Details}
+	case 400, 413:
+		withFields("requestId", reqData.RequestID, "port", port).debugf("端口 %d 拒绝了请求 (HTTP %d)", port, resp.StatusCode)
+		return sendResult{Rejection: &ExtensionRejection{Port: port, Status: resp.StatusCode}}
+	}
+
+	return sendResult{}
+}
+
+// ============================================================
+// 生成请求 ID 并注册响应通道
+// 流程：reserveRequestID 预留 ID → registerPendingRequest 注册通道
+// 预留期间到达的回调会被暂存，注册时立即投递，避免回调早于注册而丢失
+// ============================================================
+const ExpectedRequestTTL = 30 * time.Second // 预留 ID 的有效期
+
+var (
+	requestCounter   atomic.Uint64                // 请求序号，保证同一纳秒内生成的 ID 也不重复
+	expectedRequests = make(map[string]time.Time) // 已预留但尚未注册的请求 ID（受 pendingMutex 保护）
+	earlyResponses   = make(map[string]any)       // 注册前就到达的回调（受 pendingMutex 保护）
+)
+
+func newRequestID() string {
+	return fmt.Sprintf("req_%d_%d", time.Now().UnixNano(), requestCounter.Add(1))
+}
+
+// reserveRequestID 生成一个不与现有请求冲突的 ID 并预留
+func reserveRequestID() string {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	// 清理过期的预留
+	now := time.Now()
+	for id, reservedAt := range expectedRequests {
+		if now.Sub(reservedAt) > ExpectedRequestTTL {
+			delete(expectedRequests, id)
+			delete(earlyResponses, id)
+		}
+	}
+
+	requestID := newRequestID()
+	for {
+		_, pending := pendingRequests[requestID]
+		_, expected := expectedRequests[requestID]
+		if !pending && !expected {
+			break
+		}
+		debugf("请求 ID 冲突: %s，重新生成", requestID)
+		requestID = newRequestID()
+	}
+	expectedRequests[requestID] = now
+
+	return requestID
+}
+
+// registerPendingRequest 为预留的 ID 注册响应通道，若回调已提前到达则立即投递
+func registerPendingRequest(req ExtensionRequest) chan any {
+	requestID := req.RequestID
+	responseCh := make(chan any, 1)
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	delete(expectedRequests, requestID)
+	if early, ok := earlyResponses[requestID]; ok {
+		delete(earlyResponses, requestID)
+		responseCh <- early
+		infof("请求 %s 的回调早于注册到达，已投递", requestID)
+		return responseCh
+	}
+
+	pendingRequests[requestID] = &PendingRequest{
+		ch:        responseCh,
+		Type:      req.Type,
+		Category:  req.Category,
+		Reason:    req.Reason,
+		Expected:  len(req.Questions),
+		CreatedAt: time.Now(),
+		Timeout:   req.timeout,
+		Masked:    req.Masked,
+	}
+	savePendingStateLocked()
+	return responseCh
+}
+
+// markRequestDelivered 记录请求送达的扩展端口
+func markRequestDelivered(requestID string, port int) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	if pending, exists := pendingRequests[requestID]; exists {
+		pending.Port = port
+	}
+}
+
+// claimPendingRequest 从表中移除请求并返回是否移除成功
+// 返回 false 说明回调已抢先投递，结果已在响应通道中
+func claimPendingRequest(requestID string) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	if _, exists := pendingRequests[requestID]; !exists {
+		return false
+	}
+	delete(pendingRequests, requestID)
+	savePendingStateLocked()
+	return true
+}
+
+// removePendingRequest 移除未完成的请求（连接失败或调用取消时）
+func removePendingRequest(requestID string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	delete(pendingRequests, requestID)
+	savePendingStateLocked()
+}
+
+// deliverResponse 将回调结果投递给等待中的请求；请求尚未注册时暂存
+// 投递与删除在同一把锁内完成，同一请求的重复回调返回 false，不会再次写入通道
+func deliverResponse(requestID string, result any) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	if pending, exists := pendingRequests[requestID]; exists {
+		delete(pendingRequests, requestID)
+		savePendingStateLocked()
+		if resp, ok := result.(CallbackResponse); ok && pending.Expected > 0 && len(resp.Answers) < pending.Expected {
+			infof("请求 %s 只收到 %d/%d 个回答，其余视为未回答", requestID, len(resp.Answers), pending.Expected)
+		}
+		if pending.restored {
+			infof("恢复的请求 %s 已收到回复（原调用已随上次进程结束，回复仅记录）", requestID)
+		}
+		pending.ch <- result
+		return true
+	}
+
+	if _, expected := expectedRequests[requestID]; expected {
+		// 扩展重试回调时只保留第一次的回复，重复的回调与已完成的请求一样按 404 处理
+		if _, duplicate := earlyResponses[requestID]; duplicate {
+			return false
+		}
+		earlyResponses[requestID] = result
+		return true
+	}
+
+	return false
+}
+
+// ============================================================
+// 记录每个 MCP 会话最近一次的请求（供 report_progress 关联进度）
+// ============================================================
+var (
+	sessionMutex         sync.Mutex
+	lastRequestBySession = make(map[string]string) // 会话 ID → 最近的请求 ID
+)
+
+func sessionIDFromContext(ctx context.Context) string {
+	if session := server.ClientSessionFromContext(ctx); session != nil {
+		return session.SessionID()
+	}
+	return "default"
+}
+
+func recordSessionRequest(ctx context.Context, requestID string) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	lastRequestBySession[sessionIDFromContext(ctx)] = requestID
+}
+
+func lastSessionRequest(ctx context.Context) string {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	return lastRequestBySession[sessionIDFromContext(ctx)]
+}
+
+// ============================================================
+// 重试退避：以 retryInterval 为基数每次翻倍，不超过 retryMaxInterval，
+// 并叠加最多 20% 的随机抖动，避免多个实例同时启动时集中重试
+// ============================================================
+func retryBackoff(attempt int) time.Duration {
+	base := time.Duration(retryInterval) * time.Second
+	limit := time.Duration(retryMaxInterval) * time.Second
+	if base <= 0 {
+		return 0
+	}
+
+	delay := base
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+
+	jitter := time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	return delay + jitter
+}
+
+// ============================================================
+// 应答窗口信息：多窗口时告诉 AI 是哪个窗口/项目回复的
+// ============================================================
+type WindowInfo struct {
+	Port      int    `json:"port"`
+	PID       int    `json:"pid,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	Details   string `json:"details,omitempty"` // 扩展接收请求时返回的说明
+}
+
+// windowInfoFor 结合端口文件与回调中携带的工作区，生成应答窗口信息
+func windowInfoFor(port int, workspace string) *WindowInfo {
+	if port == 0 {
+		return nil
+	}
+	info := &WindowInfo{Port: port, Workspace: workspace}
+	if entry, ok := lookupPortFile(port); ok {
+		info.PID = entry.PID
+		if info.Workspace == "" {
+			info.Workspace = entry.Workspace
+		}
+	}
+	return info
+}
+
+// ============================================================
+// 请求用户输入（带重试机制）
+// ============================================================
+func requestUserInput(ctx context.Context, req ExtensionRequest) (*CallbackResponse, error) {
+	// 统计：每条返回路径都先设置 outcome
+	askStart := time.Now()
+	outcome := outcomeFailed
+	defer func() { recordAsk(outcome, time.Since(askStart), req.Category) }()
+
+	// 显示数量限制：已显示的提示达到上限时排队，等有提示结束后才发送给扩展
+	if promptSlots != nil {
+		select {
+		case promptSlots <- struct{}{}:
+		default:
+			infof("已有 %d 个提示正在显示，本次提示排队等待", cap(promptSlots))
+			select {
+			case promptSlots <- struct{}{}:
+			case <-ctx.Done():
+				outcome = outcomeCancelled
+				return nil, fmt.Errorf("调用已取消: %v", ctx.Err())
+			}
+		}
+		defer func() { <-promptSlots }()
+	}
+
+	// 创建响应通道
+	requestID := req.RequestID
+	if requestID == "" {
+		requestID = reserveRequestID()
+		req.RequestID = requestID
+	}
+	responseCh := registerPendingRequest(req)
+	reqLog := withFields("requestId", requestID)
+	recordSessionRequest(ctx, requestID)
+
+	// ============================================================
+	// 重试逻辑：次数可配置（默认 5 次），间隔指数退避并带随机抖动
+	// ============================================================
+	var connected bool
+	var lastError error
+	var delivered delivery
+
+	// 扩展拒绝请求内容时逐级缩短原因：完整 → 第一段 → 标题
+	reasons := shortenedReasons(req.Reason)
+	level := 0
+
+	for attempt := 1; attempt <= maxRetryCount; attempt++ {
+		reqLog.debugf("第 %d/%d 次尝试连接扩展...", attempt, maxRetryCount)
+
+		req.Reason = reasons[level]
+		result, err := tryConnectExtension(req)
+		if result.Port > 0 {
+			markRequestDelivered(requestID, result.Port)
+			delivered = result
+			connected = true
+			break
+		}
+
+		lastError = err
+		var rejection *ExtensionRejection
+		if errors.As(err, &rejection) {
+			// 请求可能过大：改用更短的原因立即重试，不占用连接重试次数（扩展是可达的）
+			if rejection.contentRelated() && level < len(reasons)-1 {
+				level++
+				attempt--
+				reqLog.warnf("扩展拒绝了请求，改用更短的原因重试（%d 字）", len([]rune(reasons[level])))
+				continue
+			}
+			// 扩展出错或已无法再缩短：原样重试没有意义，直接把扩展的说明交给调用方
+			removePendingRequest(requestID)
+			reqLog.errorf("%v", rejection)
+			return nil, rejection
+		}
+		if attempt < maxRetryCount {
+			delay := retryBackoff(attempt)
+			reqLog.debugf("连接失败，%v 后重试...", delay.Round(time.Millisecond))
+			// 退避期间调用被取消或超时，立即放弃，不再继续探测扩展端口
+			select {
+			case <-ctx.Done():
+				removePendingRequest(requestID)
+				outcome = outcomeCancelled
+				reqLog.infof("请求 %s 在重试等待中被取消: %v", requestID, ctx.Err())
+				return nil, fmt.Errorf("调用已取消: %v", ctx.Err())
+			case <-time.After(delay):
+			}
+		} else {
+			reqLog.warnf("已达最大重试次数 (%d 次)，放弃连接", maxRetryCount)
+		}
+	}
+
+	if !connected {
+		removePendingRequest(requestID)
+
+		connectErr := &ConnectError{Attempts: maxRetryCount, Last: lastError}
+		reqLog.errorf("最终连接失败: %v", connectErr)
+		return nil, connectErr
+	}
+
+	reqLog["port"] = delivered.Port
+	if req.Category != "" {
+		reqLog["category"] = req.Category
+		reqLog.infof("请求 %s [%s] 已发送，等待用户输入...", requestID, req.Category)
+	} else {
+		reqLog.infof("请求 %s 已发送，等待用户输入...", requestID)
+	}
+
+	// 等待用户响应（无超时，但随 MCP 调用上下文取消）
+	// 等待期间按 pendingHeartbeat 间隔输出心跳日志（debug 级别），便于发现卡住的提示
+	var heartbeat <-chan time.Time
+	if pendingHeartbeat > 0 {
+		ticker := time.NewTicker(pendingHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	var timeoutCh <-chan time.Time
+	if req.timeout > 0 {
+		timer := time.NewTimer(req.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	var result any
+waitLoop:
+	for {
+		select {
+		case result = <-responseCh:
+			break waitLoop
+		case <-heartbeat:
+			reqLog.debugf("请求 %s 已等待 %v", requestID, time.Since(askStart).Round(time.Second))
+		case <-timeoutCh:
+			// 与回调竞争：先从表中移除者获胜；回调已先到则结果必在通道中
+			if !claimPendingRequest(requestID) {
+				result = <-responseCh
+				break waitLoop
+			}
+			outcome = outcomeCancelled
+			reqLog.infof("请求 %s 等待超时 (%v)", requestID, req.timeout)
+			go dismissPrompt(delivered.Port, requestID)
+			return nil, errPromptTimeout
+		case <-ctx.Done():
+			removePendingRequest(requestID)
+			outcome = outcomeCancelled
+
+			reqLog.infof("请求 %s 已被取消: %v", requestID, ctx.Err())
+			return nil, fmt.Errorf("调用已取消: %v", ctx.Err())
+		}
+	}
+
+	switch v := result.(type) {
+	case CallbackResponse:
+		outcome = outcomeAnswered
+		v.Window = windowInfoFor(delivered.Port, v.Workspace)
+		if v.Window != nil {
+			v.Window.Details = delivered.Details
+		}
+		v.endedAware = slices.Contains(delivered.Capabilities, CapabilityEnded)
+		recordHistory(req, v.UserInput, false, askStart)
+		return &v, nil
+	case error:
+		// 用户取消或服务器关闭
+		outcome = outcomeCancelled
+		recordHistory(req, "", true, askStart)
+		return nil, v
+	default:
+		return nil, errors.New("未知错误")
+	}
+}
+
+// dismissPrompt 通知扩展关闭已超时的提示（尽力而为，旧版扩展返回 404 时忽略）
+func dismissPrompt(port int, requestID string) {
+	if port == 0 {
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"requestId": requestID})
+	resp, err := extensionClient.Post(extensionURL(port, "/dismiss"), "application/json", bytes.NewReader(data))
+	if err != nil {
+		warnf("通知扩展关闭提示 %s 失败: %v", requestID, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// deriveTitle 取原因的第一句话作为标题，最多 MaxTitleRunes 个字符（按字符截断）
+func deriveTitle(reason string) string {
+	reason = strings.TrimSpace(reason)
+	end := len(reason)
+	for i, r := range reason {
+		if strings.ContainsRune("。！？!?\n", r) {
+			end = i + utf8.RuneLen(r)
+			break
+		}
+		// 英文句号后接空白才算句末，避免截断 1.5、server.go 之类
+		if r == '.' && i+1 < len(reason) && (reason[i+1] == ' ' || reason[i+1] == '\n') {
+			end = i + 1
+			break
+		}
+	}
+	return truncateRunes(strings.TrimSpace(reason[:end]), MaxTitleRunes)
+}
+
+// 可执行内容的 HTML 标签：成对的整段删除，落单的开/闭标签单独删除
+var (
+	scriptBlockPattern = regexp.MustCompile(`(?is)<(?:script|style|iframe|object|embed)\b[^>]*>.*?</(?:script|style|iframe|object|embed)\s*>`)
+	scriptTagPattern   = regexp.MustCompile(`(?i)</?(?:script|style|iframe|object|embed)\b[^>]*>`)
+	eventAttrPattern   = regexp.MustCompile(`(?i)\son[a-z]+\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+// sanitizeMarkdown 对 markdown 原因做最小处理：统一换行符，去掉脚本类 HTML
+// 不做任何 markdown 转换，旧版扩展按纯文本显示时仍然可读
+func sanitizeMarkdown(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = scriptBlockPattern.ReplaceAllString(text, "")
+	text = scriptTagPattern.ReplaceAllString(text, "")
+	return eventAttrPattern.ReplaceAllString(text, "")
+}
+
+// shortenedReasons 生成逐级缩短的原因：完整原因、第一段、首行标题，去除重复项
+func shortenedReasons(reason string) []string {
+	reasons := []string{reason}
+	add := func(candidate string) {
+		candidate = strings.TrimSpace(candidate)
+		if candidate != "" && candidate != reasons[len(reasons)-1] {
+			reasons = append(reasons, candidate)
+		}
+	}
+
+	paragraph, _, _ := strings.Cut(strings.TrimSpace(reason), "\n\n")
+	add(paragraph)
+	title, _, _ := strings.Cut(paragraph, "\n")
+	add(truncateRunes(strings.TrimSpace(title), 80))
+	return reasons
+}
+
+// ============================================================
+// 主函数
+// ============================================================
+func main() {
+	showVersion, err := parseFlags(os.Args[1:])
+	flushStartupLogs()
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if showVersion {
+		fmt.Println(Version)
+		return
+	}
+
+	infof("Ask Continue MCP Server (Go) %s 正在初始化...", Version)
+	logResolvedConfig()
+
+	// 启动回调服务器
+	if port := startCallbackServer(); port == 0 {
+		fatalf("无法启动回调服务器")
+	}
+
+	infof("当前回调端口: %d", currentCallbackPort)
+	restorePendingRequests()
+	startStatusHeartbeat(statusInterval)
+	watchStatsSignal()
+	startIdleWatchdog(idleTimeout)
+
+	// 创建 MCP 服务器
+	hooks := &server.Hooks{}
+	hooks.AddBeforeCallTool(beginToolCallHook)
+	hooks.AddAfterCallTool(endToolCallHook)
+	hooks.AddOnError(toolCallErrorHook)
+	s := server.NewMCPServer(
+		"ask-continue-mcp-server-go",
+		Version,
+		server.WithToolCapabilities(false),
+		server.WithHooks(hooks),
+	)
+
+	// 定义 ask_continue 工具
+	docs := askContinueDocsFor(toolLang)
+	askContinueTool := mcp.NewTool(toolName,
+		mcp.WithDescription(strings.ReplaceAll(docs.Description, "ask_continue", toolName)),
+		mcp.WithString("reason",
+			mcp.Description(docs.Reason),
+		),
+		mcp.WithString("reason_file",
+			mcp.Description(docs.ReasonFile),
+		),
+		mcp.WithString("title",
+			mcp.Description(docs.Title),
+		),
+		mcp.WithString("placeholder",
+			mcp.Description(fmt.Sprintf(docs.Placeholder, MaxPlaceholderRunes)),
+		),
+		mcp.WithString("urgency",
+			mcp.Description(docs.Urgency),
+			mcp.Enum("low", "normal", "high"),
+		),
+		mcp.WithBoolean("silent",
+			mcp.Description(docs.Silent),
+		),
+		mcp.WithArray("attachments",
+			mcp.Description(fmt.Sprintf(docs.Attachments, MaxAttachmentBytes>>10)),
+			mcp.Items(map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"name":     map[string]any{"type": "string"},
+					"content":  map[string]any{"type": "string"},
+					"language": map[string]any{"type": "string"},
+				},
+				"required": []string{"content"},
+			}),
+		),
+		mcp.WithString("category",
+			mcp.Description(docs.Category),
+			mcp.Enum(askCategories...),
+		),
+		mcp.WithString("format",
+			mcp.Description(docs.Format),
+			mcp.Enum("plain", "markdown"),
+		),
+		mcp.WithArray("plan",
+			mcp.Description(docs.Plan),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithArray("next_steps",
+			mcp.Description(fmt.Sprintf(docs.NextSteps, MaxNextSteps)),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithArray("quick_replies",
+			mcp.Description(fmt.Sprintf(docs.QuickReplies, MaxQuickReplies, MaxQuickReplyLength)),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithArray("options",
+			mcp.Description(fmt.Sprintf(docs.Options, MaxQuickReplies, MaxQuickReplyLength)),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithNumber("timeout_seconds",
+			mcp.Description(docs.TimeoutSeconds),
+			mcp.Min(0),
+		),
+		mcp.WithString("default_response",
+			mcp.Description(docs.DefaultResponse),
+		),
+		mcp.WithBoolean("async",
+			mcp.Description(docs.Async),
+		),
+		mcp.WithString("language",
+			mcp.Description(docs.Language),
+			mcp.Enum("zh", "en"),
+		),
+		mcp.WithNumber("max_length",
+			mcp.Description(docs.MaxLength),
+			mcp.Min(1),
+		),
+		mcp.WithString("pattern",
+			mcp.Description(docs.Pattern),
+		),
+		mcp.WithString("expect",
+			mcp.Description(docs.Expect),
+			mcp.Enum("text", "number", "path", "url", "json"),
+		),
+	)
+
+	// 添加工具处理器
+	s.AddTool(askContinueTool, askContinueHandler)
+	s.AddTool(newAskSelectTool(), askSelectHandler)
+	s.AddTool(newAskSecretTool(), askSecretHandler)
+	s.AddTool(newAskFileTool(), askFileHandler)
+	s.AddTool(newAskMultilineTool(), askMultilineHandler)
+	s.AddTool(newNotifyTool(), notifyHandler)
+	s.AddTool(newReportProgressTool(), reportProgressHandler)
+	s.AddTool(newAskRatingTool(), askRatingHandler)
+	s.AddTool(newAskFormTool(), askFormHandler)
+	s.AddTool(newAskBatchTool(), askBatchHandler)
+	s.AddTool(newAskDiffApprovalTool(), askDiffApprovalHandler)
+	s.AddTool(newAskCommandApprovalTool(), askCommandApprovalHandler)
+	s.AddTool(newScheduleCheckInTool(), scheduleCheckInHandler)
+	s.AddTool(newSetQuickRepliesTool(), setQuickRepliesHandler)
+	s.AddTool(newExtensionStatusTool(), extensionStatusHandler)
+	s.AddTool(newListPendingTool(), listPendingHandler)
+	s.AddTool(newConversationStatsTool(), conversationStatsHandler)
+	s.AddTool(newGetLastResponseTool(), getLastResponseHandler)
+	s.AddTool(newGetContinuationTool(), getContinuationHandler)
+	s.AddTool(newEndConversationTool(), endConversationHandler)
+
+	// 收到退出信号时优雅关闭回调服务器
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		infof("收到信号 %v，正在关闭...", sig)
+		shutdownCallbackServer()
+		shutdownMCPTransport()
+		os.Exit(0)
+	}()
+
+	// 启动服务器
+	infof("Windsurf Ask Continue MCP Server (Go) 已启动")
+
+	err = serveMCP(s)
+	shutdownCallbackServer()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fatalf("服务器错误: %v", err)
+	}
+}
+
+// ============================================================
+// ask_continue 工具处理器
+// ============================================================
+func askContinueHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	// 参数错误也按调用的语言返回
+	lang := strings.ToLower(strings.TrimSpace(argString(request, "language")))
+	m := messagesFor(lang)
+	invalid := func(err error) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultError(localizedError(m, err)), nil
+	}
+
+	// 获取 reason / reason_file 参数
+	reason, err := resolveReason(request)
+	if err != nil {
+		return invalid(err)
+	}
+	// 先于标题推导和改写检查，打码后的原因才会出现在提示、日志和结果中
+	reason, err = checkSecrets("reason", reason)
+	if err != nil {
+		return invalid(err)
+	}
+
+	plan, err := argStringSlice(request, "plan")
+	if err != nil {
+		return invalid(err)
+	}
+	quickReplies, err := parseQuickReplies(request)
+	if err != nil {
+		return invalid(err)
+	}
+	nextSteps, err := argStringSlice(request, "next_steps")
+	if err != nil {
+		return invalid(err)
+	}
+	if len(nextSteps) > MaxNextSteps {
+		return invalid(argError("tooMany", "next_steps", MaxNextSteps, len(nextSteps)))
+	}
+	title := strings.TrimSpace(argString(request, "title"))
+	if title == "" {
+		title = deriveTitle(reason)
+	}
+	// 占位提示只有一行，换行改为空格
+	placeholder := strings.Join(strings.Fields(argString(request, "placeholder")), " ")
+	placeholder = truncateRunes(placeholder, MaxPlaceholderRunes)
+
+	// options 为新增字段，旧版扩展会忽略，仍显示为普通输入框
+	options, err := parseButtonLabels(request, "options")
+	if err != nil {
+		return invalid(err)
+	}
+	timeoutSeconds, _ := argInt(request, "timeout_seconds")
+	if timeoutSeconds < 0 {
+		return invalid(argError("negative", "timeout_seconds"))
+	}
+	defaultResponse := strings.TrimSpace(argString(request, "default_response"))
+	if defaultResponse == "" {
+		defaultResponse = "continue"
+	}
+	maxLength, ok := argInt(request, "max_length")
+	if ok && maxLength < 1 {
+		return invalid(argError("notPositive", "max_length"))
+	}
+	// 回答需要整体匹配，与输入框的 pattern 校验一致
+	pattern := argString(request, "pattern")
+	var answerPattern *regexp.Regexp
+	if pattern != "" {
+		answerPattern, err = regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return invalid(argError("badPattern", "pattern", err))
+		}
+	}
+	expect := strings.ToLower(strings.TrimSpace(argString(request, "expect")))
+	switch expect {
+	case "", "text":
+		expect = ""
+	case "number", "path", "url", "json":
+	default:
+		return invalid(argError("oneOf", "expect", "text / number / path / url / json", expect))
+	}
+	urgency := strings.ToLower(strings.TrimSpace(argString(request, "urgency")))
+	switch urgency {
+	case "low", "normal", "high":
+	case "":
+		urgency = "normal"
+	default:
+		// 紧急程度只影响显示，无效值不值得让调用失败
+		warnf("未知的 urgency %q，按 normal 处理", urgency)
+		urgency = "normal"
+	}
+	// 显式的 silent 参数优先；未指定时低紧急程度或 ASK_CONTINUE_DEFAULT_SILENT 视为静默
+	silent, ok := argOptionalBool(request, "silent")
+	if !ok {
+		silent = defaultSilent || urgency == "low"
+	}
+	// 附件只用于提示界面，不会出现在工具结果中
+	attachments, err := parseAttachments(request)
+	if err != nil {
+		return invalid(err)
+	}
+	category := strings.ToLower(strings.TrimSpace(argString(request, "category")))
+	if category != "" && !slices.Contains(askCategories, category) {
+		return invalid(argError("oneOf", "category", strings.Join(askCategories, " / "), category))
+	}
+	format := strings.ToLower(strings.TrimSpace(argString(request, "format")))
+	switch format {
+	case "", "plain":
+		format = ""
+	case "markdown":
+	default:
+		return invalid(argError("oneOf", "format", "plain / markdown", format))
+	}
+
+	args := askContinueArgs{
+		reason:          reason,
+		title:           title,
+		placeholder:     placeholder,
+		format:          format,
+		urgency:         urgency,
+		silent:          silent,
+		category:        category,
+		attachments:     attachments,
+		plan:            plan,
+		nextSteps:       nextSteps,
+		quickReplies:    quickReplies,
+		options:         options,
+		timeoutSeconds:  timeoutSeconds,
+		maxLength:       maxLength,
+		pattern:         pattern,
+		answerPattern:   answerPattern,
+		expect:          expect,
+		defaultResponse: defaultResponse,
+		lang:            lang,
+	}
+	if err := checkArgsSecrets(&args); err != nil {
+		return invalid(err)
+	}
+
+	infof("%s 被调用，原因: %s", toolName, reason)
+	if args.placeholder != "" {
+		debugf("输入框占位提示: %s", args.placeholder)
+	}
+	args.prompt = transformReason(reason)
+	if format == "markdown" {
+		args.prompt = sanitizeMarkdown(args.prompt)
+	}
+
+	// 异步模式：立即返回句柄，结果稍后通过 get_continuation 获取
+	if argBool(request, "async") {
+		return startAsyncContinuation(ctx, args), nil
+	}
+	return waitAskContinue(ctx, args), nil
+}
+
+// askCategories 询问原因的分类：完成了任务 / 遇到错误 / 需要用户决策才能继续 / 有问题要澄清
+var askCategories = []string{"completion", "error", "blocked", "question"}
+
+// askContinueArgs ask_continue 解析后的参数
+type askContinueArgs struct {
+	requestID       string // 预留的请求 ID，为空时由 requestUserInput 生成
+	reason          string
+	title           string
+	placeholder     string
+	prompt          string // 改写后展示给用户的原因
+	format          string // 空表示纯文本
+	urgency         string // low / normal / high
+	silent          bool   // 不播放提示音，也不发送系统通知
+	category        string // askCategories 之一，未指定为空
+	attachments     []Attachment
+	plan            []string
+	nextSteps       []string
+	quickReplies    []string
+	options         []string
+	timeoutSeconds  int
+	maxLength       int            // 回答的最大字数，0 表示不限
+	pattern         string         // 调用方给出的原始正则，转发给扩展
+	answerPattern   *regexp.Regexp // 服务器端复核用的整体匹配正则
+	expect          string         // 期望的回答格式，空表示普通文本
+	defaultResponse string
+	lang            string // 返回文本的语言，为空时使用 ASK_CONTINUE_LANG
+}
+
+// waitAskContinue 发送提示并等待用户回复，返回最终的工具结果
+func waitAskContinue(ctx context.Context, a askContinueArgs) *mcp.CallToolResult {
+	m := messagesFor(a.lang)
+	tmpl := resultTemplateFor(m)
+
+	if a.urgency == "high" && !a.silent {
+		sendDesktopNotification("Ask Continue: "+a.title, a.reason)
+	}
+
+	askStart := time.Now()
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:         "ask_continue",
+		RequestID:    a.requestID,
+		Title:        a.title,
+		Format:       a.format,
+		Urgency:      a.urgency,
+		Category:     a.category,
+		Attachments:  a.attachments,
+		Silent:       a.silent,
+		Reason:       a.prompt,
+		Plan:         a.plan,
+		NextSteps:    a.nextSteps,
+		QuickReplies: a.quickReplies,
+		Options:      a.options,
+		MaxLength:    a.maxLength,
+		Pattern:      a.pattern,
+		Placeholder:  a.placeholder,
+		Expect:       a.expect,
+		timeout:      time.Duration(a.timeoutSeconds) * time.Second,
+	})
+
+	// 汇总本次询问的结构化信息，JSON 格式结果使用
+	meta := AskResult{WaitSeconds: time.Since(askStart).Seconds()}
+	var imageNote string
+	if resp != nil {
+		meta.RequestID = resp.RequestID
+		meta.UserInput = resp.UserInput
+		var dropped int
+		meta.Images, dropped = usableImages(resp.Images)
+		if dropped > 0 {
+			imageNote = fmt.Sprintf(m.InvalidImages, dropped)
+		}
+	}
+	meta.Cancelled = errors.Is(err, errUserCancelled) || ctx.Err() != nil
+	finish := func(cont bool, message string) *mcp.CallToolResult {
+		meta.Continue = cont
+		meta.Message = message + imageNote
+		return continueResult(meta)
+	}
+
+	// 超时未回复：按默认回复自动继续，并明确标注
+	if errors.Is(err, errPromptTimeout) {
+		autoInput := fmt.Sprintf(m.TimeoutContinue, a.timeoutSeconds, a.defaultResponse)
+		return finish(true, renderResultTemplate(tmpl, autoInput, a.reason,
+			formatPlanSection(m, a.plan, nil), "",
+		))
+	}
+
+	// 可配置：用户取消视为按默认指令继续
+	if errors.Is(err, errUserCancelled) && cancelAsDefault {
+		infof("用户取消，按默认指令继续")
+		return finish(true, renderResultTemplate(tmpl, cancelInstructionFor(m), a.reason,
+			formatPlanSection(m, a.plan, nil), "",
+		))
+	}
+
+	// 扩展可达但拒绝了请求：给出扩展的错误说明，不要让用户去检查扩展是否安装
+	var rejection *ExtensionRejection
+	if errors.As(err, &rejection) {
+		details := rejection.Message
+		if rejection.Details != "" {
+			details = strings.TrimPrefix(details+"\n"+rejection.Details, "\n")
+		}
+		if details == "" {
+			details = fmt.Sprintf("HTTP %d", rejection.Status)
+		}
+		return finish(false, fmt.Sprintf(m.ExtensionRejected, rejection.Port, details))
+	}
+
+	// 用户取消或调用被取消：与连接失败区分，不要让 AI 去检查扩展是否安装
+	if errors.Is(err, errUserCancelled) {
+		return finish(false, m.Cancelled)
+	}
+	if err != nil && ctx.Err() != nil {
+		return finish(false, fmt.Sprintf(m.CallCancelled, ctx.Err()))
+	}
+
+	// 连接失败时返回友好提示
+	if err != nil {
+		return finish(false, fmt.Sprintf(m.NotConnected, localizedError(m, err)))
+	}
+
+	userInput := resp.UserInput
+	if resp.IsEnded() {
+		return finish(false, m.Ended)
+	}
+	if userInput == "" {
+		// 新版扩展明确表示未结束：用户只是直接点了继续
+		userInput = m.EmptyInput
+	}
+
+	// 相同原因被反复秒回（自动回复），判定为死循环并强制结束
+	if detectAskLoop(a.reason, time.Since(askStart)) {
+		infof("检测到 %s 死循环：相同原因连续 %d 次被自动回复，强制结束", toolName, loopLimit)
+		return finish(false, fmt.Sprintf(m.LoopDetected, loopLimit, AutoReplyThreshold, a.reason, toolName))
+	}
+
+	// 用户直接粘贴了 patch：单独放进结构化字段，AI 可以直接应用
+	var patchNote string
+	if detectPatch && looksLikePatch(resp.UserInput) {
+		meta.Patch = resp.UserInput
+		patchNote = m.PatchNote
+	}
+
+	// 旧版扩展不会在输入框中限制，服务器复核回答；不符合时仍返回原文，由 AI 决定是否重新询问
+	var validationNote string
+	if resp.UserInput != "" {
+		if runes := utf8.RuneCountInString(resp.UserInput); a.maxLength > 0 && runes > a.maxLength {
+			meta.ValidationError = fmt.Sprintf("answer has %d characters, max_length is %d", runes, a.maxLength)
+			validationNote = fmt.Sprintf(m.AnswerTooLong, runes, a.maxLength)
+		} else if a.answerPattern != nil && !a.answerPattern.MatchString(resp.UserInput) {
+			meta.ValidationError = fmt.Sprintf("answer does not match pattern %q", a.pattern)
+			validationNote = fmt.Sprintf(m.AnswerMismatch, a.pattern)
+		}
+	}
+
+	// 按 expect 解析回答，附上规范化结果；解析失败只附带说明，由 AI 决定如何处理
+	if a.expect != "" && resp.UserInput != "" {
+		meta.Expect = a.expect
+		if normalized, err := parseExpectedAnswer(a.expect, resp.UserInput); err != nil {
+			meta.ParseError = err.Error()
+			validationNote += fmt.Sprintf(m.ExpectFailed, a.expect, err)
+		} else {
+			meta.Normalized = normalized
+			validationNote += fmt.Sprintf(m.ExpectParsed, a.expect, normalized)
+		}
+	}
+
+	// 返回用户指令
+	return finish(true, renderResultTemplate(tmpl, userInput, a.reason,
+		formatPlanSection(m, a.plan, resp.Plan)+formatNextStepsSection(m, a.nextSteps, resp.ApprovedSteps),
+		formatWindowSection(m, resp.Window),
+	)+patchNote+validationNote)
+}
+
+// parseExpectedAnswer 按 expect 解析用户的回答，返回规范化后的文本
+func parseExpectedAnswer(expect, answer string) (string, error) {
+	answer = strings.TrimSpace(answer)
+	switch expect {
+	case "number":
+		value, err := strconv.ParseFloat(answer, 64)
+		if err != nil {
+			return "", fmt.Errorf("not a number: %q", answer)
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case "path":
+		path := answer
+		if home, err := os.UserHomeDir(); err == nil && (path == "~" || strings.HasPrefix(path, "~/")) {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+		// 相对路径相对于本服务器所服务的项目目录
+		if !filepath.IsAbs(path) && serverWorkspace != "" {
+			path = filepath.Join(serverWorkspace, path)
+		}
+		path = filepath.Clean(path)
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("path %s: %v", path, errors.Unwrap(err))
+		}
+		return path, nil
+	case "url":
+		u, err := url.Parse(answer)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return "", fmt.Errorf("not an absolute URL: %q", answer)
+		}
+		return u.String(), nil
+	case "json":
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(answer)); err != nil {
+			return "", fmt.Errorf("invalid JSON: %v", err)
+		}
+		return compact.String(), nil
+	}
+	return answer, nil
+}
+
+// looksLikePatch 粗略判断文本是否为 unified diff / patch：第一行非空内容以 diff、---、+++ 开头
+func looksLikePatch(text string) bool {
+	text = strings.TrimLeft(text, " \t\r\n")
+	firstLine, _, _ := strings.Cut(text, "\n")
+	for _, prefix := range []string{"diff ", "--- ", "+++ "} {
+		if strings.HasPrefix(firstLine, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================
+// 原因来源：reason 参数和/或 reason_file 指向的文件
+// 两者都提供时按 ASK_CONTINUE_REASON_PRECEDENCE 处理
+// ============================================================
+const MaxReasonFileBytes = 64 << 10 // reason_file 最大字节数
+
+func resolveReason(request mcp.CallToolRequest) (string, error) {
+	inline := strings.TrimSpace(argString(request, "reason"))
+	path := strings.TrimSpace(argString(request, "reason_file"))
+
+	var fromFile string
+	if path != "" {
+		content, err := readReasonFile(path)
+		if err != nil {
+			return "", err
+		}
+		fromFile = content
+	}
+
+	switch {
+	case fromFile == "" && inline == "":
+		return "任务已完成", nil
+	case fromFile == "":
+		return inline, nil
+	case inline == "":
+		infof("原因来自文件 %s", path)
+		return fromFile, nil
+	}
+
+	switch reasonPrecedence {
+	case "inline":
+		infof("同时提供了 reason 和 reason_file，按配置使用 reason")
+		return inline, nil
+	case "concat":
+		infof("同时提供了 reason 和 reason_file，按配置拼接（reason 在前，文件 %s 在后）", path)
+		return inline + "\n\n" + fromFile, nil
+	default:
+		infof("同时提供了 reason 和 reason_file，按配置使用文件 %s", path)
+		return fromFile, nil
+	}
+}
+
+// readReasonFile 读取 reason_file，只接受不超过 MaxReasonFileBytes 的普通文件
+func readReasonFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", argError("reasonFileRead", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", argError("reasonFileIrregular", path)
+	}
+	if info.Size() > MaxReasonFileBytes {
+		return "", argError("reasonFileTooLarge", info.Size(), MaxReasonFileBytes)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", argError("reasonFileRead", err)
+	}
+	if !utf8.Valid(data) {
+		return "", argError("reasonFileNotUTF8", path)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ============================================================
+// 将原因转换为提问（可选）
+// AI 常把原因写成陈述句，可通过模板或本地命令改写成问句再展示给用户
+// ============================================================
+const ReasonCommandTimeout = 3 * time.Second // 改写命令的最长执行时间
+
+func transformReason(reason string) string {
+	if reasonCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), ReasonCommandTimeout)
+		defer cancel()
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", reasonCommand)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", reasonCommand)
+		}
+		cmd.Stdin = strings.NewReader(reason)
+		output, err := cmd.Output()
+		if err != nil {
+			warnf("原因改写命令执行失败，使用原始原因: %v", err)
+			return reason
+		}
+		if transformed := strings.TrimSpace(string(output)); transformed != "" {
+			return transformed
+		}
+		return reason
+	}
+
+	if reasonTemplate != "" {
+		return strings.ReplaceAll(reasonTemplate, "{reason}", reason)
+	}
+	return reason
+}
+
+// ============================================================
+// 死循环检测
+// 自动回复模式下，AI 可能以相同原因不断调用 ask_continue 而毫无进展
+// ============================================================
+const (
+	DefaultLoopLimit   = 5               // 默认连续重复次数阈值
+	AutoReplyThreshold = 2 * time.Second // 快于此时间的回复视为自动回复
+)
+
+var (
+	loopMutex       sync.Mutex
+	lastLoopReason  string // 上一次被自动回复的原因
+	loopRepeatCount int    // 相同原因连续被自动回复的次数
+)
+
+// detectAskLoop 记录一次回复，相同原因连续被自动回复达到阈值时返回 true
+func detectAskLoop(reason string, wait time.Duration) bool {
+	if loopLimit <= 0 {
+		return false
+	}
+
+	loopMutex.Lock()
+	defer loopMutex.Unlock()
+
+	if wait >= AutoReplyThreshold {
+		// 真人回复，重置计数
+		lastLoopReason = ""
+		loopRepeatCount = 0
+		return false
+	}
+
+	if reason == lastLoopReason {
+		loopRepeatCount++
+	} else {
+		lastLoopReason = reason
+		loopRepeatCount = 1
+	}
+
+	if loopRepeatCount >= loopLimit {
+		lastLoopReason = ""
+		loopRepeatCount = 0
+		return true
+	}
+	return false
+}
+
+// formatWindowSection 生成应答窗口段落（未知时为空）
+func formatWindowSection(m *serverMessages, window *WindowInfo) string {
+	if window == nil {
+		return ""
+	}
+	text := fmt.Sprintf(m.WindowFrom, window.Port)
+	var details []string
+	if window.PID > 0 {
+		details = append(details, fmt.Sprintf(m.WindowPID, window.PID))
+	}
+	if window.Workspace != "" {
+		details = append(details, fmt.Sprintf(m.WindowWorkspace, window.Workspace))
+	}
+	if len(details) > 0 {
+		text += fmt.Sprintf(m.WindowDetails, strings.Join(details, m.ListSep))
+	}
+	if window.Details != "" {
+		text += fmt.Sprintf(m.WindowHint, window.Details)
+	}
+	return text + "\n\n"
+}
+
+// ============================================================
+// 结果文本模板
+// 占位符：{userInput} 用户指令、{reason} 本次询问原因、{plan} 计划段落、{window} 应答窗口
+// ============================================================
+// 默认模板随语言不同，见 messagesByLang 的 ResultTemplate
+
+// QuietResultTemplate ASK_CONTINUE_SUPPRESS_REMINDER=1 时使用：只返回用户指令，不附加强制提醒
+const QuietResultTemplate = "{userInput}\n\n{plan}{window}"
+
+var templatePlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// validateResultTemplate 模板必须包含 {userInput}，且不能有未知占位符
+func validateResultTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, "{userInput}") {
+		return errors.New("缺少 {userInput} 占位符")
+	}
+	for _, match := range templatePlaceholder.FindAllStringSubmatch(tmpl, -1) {
+		switch match[1] {
+		case "userInput", "reason", "plan", "window":
+		default:
+			return fmt.Errorf("未知占位符 %s", match[0])
+		}
+	}
+	return nil
+}
+
+func renderResultTemplate(tmpl, userInput, reason, plan, window string) string {
+	// 单次替换，用户输入中出现的占位符文本不会被再次展开
+	// 计划、窗口等段落为空时模板末尾会留下空行，一并去掉
+	return strings.TrimRight(strings.NewReplacer(
+		"{userInput}", userInput,
+		"{reason}", reason,
+		"{plan}", plan,
+		"{window}", window,
+	).Replace(tmpl), "\n")
+}
+
+// AskResult ask_continue 的结构化结果（ASK_CONTINUE_RESULT_FORMAT=json 时返回）
+type AskResult struct {
+	Continue    bool    `json:"continue"`            // AI 是否应继续工作
+	Message     string  `json:"message"`             // 与 text 格式相同的提示文本
+	UserInput   string  `json:"userInput"`           // 用户的原始输入
+	Cancelled   bool    `json:"cancelled"`           // 用户或客户端取消了本次询问
+	WaitSeconds float64 `json:"waitSeconds"`         // 从发起询问到得到结果的秒数
+	RequestID   string  `json:"requestId,omitempty"` // 请求 ID，连接失败时为空
+	Patch       string  `json:"patch,omitempty"`     // 用户输入是 diff / patch 时的原文，可直接应用
+	// 回答不符合 max_length / pattern 时的说明，为空表示通过或未设置
+	ValidationError string `json:"validationError,omitempty"`
+	// expect 不为 text 时的解析结果：成功时 normalized 为规范化后的回答，失败时 parseError 说明原因
+	Expect     string `json:"expect,omitempty"`
+	Normalized string `json:"normalized,omitempty"`
+	ParseError string `json:"parseError,omitempty"`
+
+	Images []CallbackImage `json:"-"` // 用户附带的图片，作为图片内容块附加在结果后
+}
+
+// continueResult 生成 ask_continue 的结果
+// json 格式返回序列化后的 AskResult；text 格式返回提示文本，
+// 开启 ASK_CONTINUE_RESULT_PREFIX_FLAG 时在首行加上机器可读的 "CONTINUE: true/false"
+func continueResult(result AskResult) *mcp.CallToolResult {
+	text := result.Message
+	if resultPrefixFlag {
+		text = fmt.Sprintf("CONTINUE: %t\n\n%s", result.Continue, text)
+	}
+	if resultFormat == "json" {
+		if data, err := json.Marshal(result); err == nil {
+			text = string(data)
+		} else {
+			warnf("序列化结果失败，改用文本格式: %v", err)
+		}
+	}
+
+	toolResult := mcp.NewToolResultText(text)
+	for _, image := range result.Images {
+		toolResult.Content = append(toolResult.Content, mcp.NewImageContent(image.Data, image.MimeType))
+	}
+	return toolResult
+}
+
+// formatPlanSection 生成用户确认后的计划段落（未提供计划时为空）
+func formatPlanSection(m *serverMessages, proposed, approved []string) string {
+	if len(proposed) == 0 && len(approved) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	if approved == nil {
+		// 扩展未返回计划（旧版扩展），视为按原计划执行
+		sb.WriteString(m.PlanUnchanged)
+		approved = proposed
+	} else if slices.Equal(proposed, approved) {
+		sb.WriteString(m.PlanConfirmed)
+	} else {
+		sb.WriteString(m.PlanEdited)
+	}
+	for i, step := range approved {
+		fmt.Fprintf(&sb, "%d. %s\n", i+1, step)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// formatNextStepsSection 列出用户批准和划掉的下一步
+// 扩展未返回 approvedSteps（旧版扩展）时为空，以用户的文字回复为准
+func formatNextStepsSection(m *serverMessages, proposed, approved []string) string {
+	if len(proposed) == 0 || approved == nil {
+		return ""
+	}
+
+	var struck []string
+	for _, step := range proposed {
+		if !slices.Contains(approved, step) {
+			struck = append(struck, step)
+		}
+	}
+
+	var sb strings.Builder
+	if len(approved) == 0 {
+		sb.WriteString(m.StepsNoneApproved)
+	} else {
+		sb.WriteString(m.StepsApproved)
+		for i, step := range approved {
+			fmt.Fprintf(&sb, "%d. %s\n", i+1, step)
+		}
+		if len(struck) > 0 {
+			sb.WriteString(m.StepsStruck)
+		}
+	}
+	for _, step := range struck {
+		fmt.Fprintf(&sb, "- %s\n", step)
+	}
+	sb.WriteString("\n")
+	return sb.String()
 }
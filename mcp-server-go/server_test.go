@@ -0,0 +1,1854 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// ============================================================
+// 测试公共设施
+// ============================================================
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// init 已按真实环境设置端口文件目录，测试一律改到临时目录，不碰本机正在运行的扩展
+	dir, err := os.MkdirTemp("", "ask-continue-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	portFileDir = dir
+	if !testing.Verbose() {
+		logger.SetOutput(io.Discard)
+	}
+	// 测试不经过 main：输出 init 暂存的启动日志，之后的日志直接输出
+	flushStartupLogs()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// override 在测试期间替换全局变量，测试结束时恢复
+func override[T any](t *testing.T, target *T, value T) {
+	t.Helper()
+	old := *target
+	*target = value
+	t.Cleanup(func() { *target = old })
+}
+
+// useTempPortDir 使用临时端口文件目录；后台写入的待处理请求文件完成后才清理目录
+func useTempPortDir(t *testing.T) {
+	t.Helper()
+	override(t, &portFileDir, t.TempDir())
+	t.Cleanup(pendingStateWrites.Wait)
+}
+
+// startTestServer 在独立的端口文件目录下启动回调服务器，返回其地址
+// 重试不等待、只尝试一次，循环检测关闭（需要的测试自行打开）
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	useTempPortDir(t)
+	override(t, &maxRetryCount, 1)
+	override(t, &retryInterval, 0)
+	override(t, &loopLimit, 0)
+	override(t, &lastPortScan, nil)
+	override(t, &lastPort, 0)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := serveCallback(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	override(t, &currentCallbackPort, listener.Addr().(*net.TCPAddr).Port)
+	return "http://" + listener.Addr().String()
+}
+
+// syncBuffer 可并发写入的日志缓冲区
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog 在测试期间按 level 过滤并收集日志
+func captureLog(t *testing.T, level logLevel) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	override(t, &logger, log.New(buf, "", 0))
+	override(t, &currentLogLevel, level)
+	override(t, &jsonLogs, false)
+	return buf
+}
+
+// fakeExtension 模拟 VS Code 扩展：登记端口文件，记录收到的请求，并按 reply 回调
+type fakeExtension struct {
+	port     int
+	requests chan ExtensionRequest
+	replies  sync.WaitGroup // 后台发送中的回调
+}
+
+// newFakeExtension reply 返回 nil 表示不回复（模拟用户一直不操作）
+func newFakeExtension(t *testing.T, reply func(ExtensionRequest) *CallbackResponse) *fakeExtension {
+	t.Helper()
+	ext := &fakeExtension{requests: make(chan ExtensionRequest, 32)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ask" {
+			http.NotFound(w, r)
+			return
+		}
+		var req ExtensionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case ext.requests <- req:
+		default:
+		}
+		json.NewEncoder(w).Encode(ExtensionResponse{Success: true})
+
+		if reply == nil {
+			return
+		}
+		if resp := reply(req); resp != nil {
+			resp.RequestID = req.RequestID
+			ext.replies.Add(1)
+			go func() {
+				defer ext.replies.Done()
+				postJSON(fmt.Sprintf("http://127.0.0.1:%d/response", req.CallbackPort), req.Token, resp)
+			}()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	// 回调处理在唤醒工具调用之后才记日志，等回调结束再恢复日志等配置
+	t.Cleanup(ext.replies.Wait)
+	ext.port = srv.Listener.Addr().(*net.TCPAddr).Port
+	writeTestPortFile(t, PortFile{Port: ext.port, PID: os.Getpid(), Time: 1})
+	return ext
+}
+
+// next 等待扩展收到的下一个请求
+func (ext *fakeExtension) next(t *testing.T) ExtensionRequest {
+	t.Helper()
+	select {
+	case req := <-ext.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("扩展没有收到请求")
+		return ExtensionRequest{}
+	}
+}
+
+// writeTestPortFile 在当前端口文件目录下写入端口文件，文件名按 PID 和端口区分
+func writeTestPortFile(t *testing.T, entry PortFile) string {
+	t.Helper()
+	data, _ := json.Marshal(entry)
+	path := filepath.Join(portFileDir, fmt.Sprintf("%d-%d.port", entry.PID, entry.Port))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// postJSON 以扩展的方式 POST JSON，返回状态码（请求失败时为 0）
+func postJSON(url, token string, body any) int {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Ask-Continue-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// callTool 以给定参数调用工具处理器
+func callTool(t *testing.T, handler server.ToolHandlerFunc, args map[string]any) *mcp.CallToolResult {
+	t.Helper()
+	var request mcp.CallToolRequest
+	request.Params.Arguments = args
+	result, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("处理器返回错误: %v", err)
+	}
+	return result
+}
+
+// resultText 拼接结果中的全部文本块
+func resultText(result *mcp.CallToolResult) string {
+	var sb strings.Builder
+	for _, content := range result.Content {
+		if text, ok := content.(mcp.TextContent); ok {
+			sb.WriteString(text.Text)
+		}
+	}
+	return sb.String()
+}
+
+// ============================================================
+// 计划确认
+// ============================================================
+
+func TestFormatPlanSection(t *testing.T) {
+	m := messagesFor("zh")
+	tests := []struct {
+		name     string
+		proposed []string
+		approved []string
+		want     string
+	}{
+		{"no plan", nil, nil, ""},
+		{"old extension keeps proposed plan", []string{"a", "b"}, nil, m.PlanUnchanged + "1. a\n2. b\n\n"},
+		{"confirmed unchanged", []string{"a", "b"}, []string{"a", "b"}, m.PlanConfirmed + "1. a\n2. b\n\n"},
+		{"edited", []string{"a", "b"}, []string{"b", "c"}, m.PlanEdited + "1. b\n2. c\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatPlanSection(m, tt.proposed, tt.approved); got != tt.want {
+				t.Errorf("formatPlanSection() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskContinueReturnsEditedPlan(t *testing.T) {
+	startTestServer(t)
+	ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: "go", Plan: []string{"写测试", "再重构"}}
+	})
+
+	result := callTool(t, askContinueHandler, map[string]any{
+		"reason":   "准备重构",
+		"plan":     []any{"重构", "写测试"},
+		"language": "zh",
+	})
+	text := resultText(result)
+
+	sent := ext.next(t)
+	if strings.Join(sent.Plan, ",") != "重构,写测试" {
+		t.Errorf("扩展收到的计划 = %v", sent.Plan)
+	}
+	if !strings.Contains(text, messagesFor("zh").PlanEdited+"1. 写测试\n2. 再重构") {
+		t.Errorf("结果中没有编辑后的计划:\n%s", text)
+	}
+}
+
+// ============================================================
+// 端口发现
+// ============================================================
+
+// deadPID 返回一个已经退出的进程 ID
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestScanPortFilesPrefersLiveProcesses(t *testing.T) {
+	useTempPortDir(t)
+	dead := deadPID(t)
+	self := os.Getpid()
+
+	// 40001 同时被残留文件（更新）和存活窗口（更旧）占用，只能保留存活的那条
+	writeTestPortFile(t, PortFile{Port: 40001, PID: dead, Time: 300})
+	writeTestPortFile(t, PortFile{Port: 40001, PID: self, Time: 100})
+	writeTestPortFile(t, PortFile{Port: 40002, PID: self, Time: 200})
+	writeTestPortFile(t, PortFile{Port: 40003, PID: dead, Time: 400})
+
+	ports := scanPortFiles()
+	if want := []int{40002, 40001}; !slices.Equal(ports, want) {
+		t.Fatalf("scanPortFiles() = %v, want %v", ports, want)
+	}
+	if entry, _ := lookupPortFile(40001); entry.PID != self {
+		t.Errorf("端口 40001 记录的 PID = %d, want %d", entry.PID, self)
+	}
+}
+
+// 端口文件目录读取缓慢（网络挂载）时，按时限返回上次发现的端口，后续调用复用同一次扫描
+func TestDiscoverExtensionPortsSlowDirectory(t *testing.T) {
+	useTempPortDir(t)
+	override(t, &discoveryTimeout, 50*time.Millisecond)
+	override(t, &lastPortScan, []int{40123})
+	override(t, &activePortScan, nil)
+
+	var reads atomic.Int32
+	release := make(chan struct{})
+	override(t, &readPortDir, func(dir string) ([]os.DirEntry, error) {
+		reads.Add(1)
+		<-release
+		return nil, nil
+	})
+
+	for range 2 {
+		start := time.Now()
+		ports := discoverExtensionPorts()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("扫描慢速目录阻塞了 %v", elapsed)
+		}
+		if !slices.Equal(ports, []int{40123}) {
+			t.Errorf("discoverExtensionPorts() = %v, want 上次的结果 [40123]", ports)
+		}
+	}
+	if n := reads.Load(); n != 1 {
+		t.Errorf("目录被读取了 %d 次，超时的扫描应被复用", n)
+	}
+
+	// 扫描完成后结果为空目录，回退到默认端口
+	close(release)
+	override(t, &discoveryTimeout, 0)
+	if ports := discoverExtensionPorts(); !slices.Equal(ports, []int{DefaultExtensionPort}) {
+		t.Errorf("扫描完成后 discoverExtensionPorts() = %v", ports)
+	}
+}
+
+func TestCleanPorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []int
+		want  []int
+	}{
+		{"empty", nil, []int{}},
+		{"keeps order", []int{23985, 23983}, []int{23985, 23983}},
+		{"drops duplicates", []int{23983, 23985, 23983}, []int{23983, 23985}},
+		{"drops out of range", []int{0, -1, 23983, 65536, 65535}, []int{23983, 65535}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanPorts(tt.ports); !slices.Equal(got, tt.want) {
+				t.Errorf("cleanPorts(%v) = %v, want %v", tt.ports, got, tt.want)
+			}
+		})
+	}
+}
+
+// 写入时间相同时按端口号排序；端口号非法的文件被忽略
+func TestScanPortFilesIsDeterministic(t *testing.T) {
+	useTempPortDir(t)
+	override(t, &serverWorkspace, "")
+	self := os.Getpid()
+	for _, pf := range []PortFile{
+		{Port: 40003, PID: self, Time: 100},
+		{Port: 40001, PID: self, Time: 100},
+		{Port: 40002, PID: self, Time: 200},
+		{Port: 70000, PID: self, Time: 300},
+		{Port: 0, PID: self, Time: 300},
+	} {
+		writeTestPortFile(t, pf)
+	}
+
+	want := []int{40002, 40001, 40003}
+	for range 5 {
+		if got := scanPortFiles(); !slices.Equal(got, want) {
+			t.Fatalf("scanPortFiles() = %v, want %v", got, want)
+		}
+	}
+}
+
+// ============================================================
+// 向扩展发送请求
+// ============================================================
+
+// 每个端口的响应体都在 sendToExtensionPort 内读尽并关闭，同一端口的后续请求复用同一个连接
+func TestSendToExtensionPortReusesConnection(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		delivered bool
+	}{
+		{"accepted", 200, `{"success":true}`, true},
+		{"rejected", 400, `{"error":"bad request"}`, false},
+		{"extension error", 500, `{"error":"boom","details":"` + strings.Repeat("x", 8<<10) + `"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var newConns atomic.Int32
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					newConns.Add(1)
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+
+			client := &http.Client{Transport: &http.Transport{}}
+			port := srv.Listener.Addr().(*net.TCPAddr).Port
+			for i := 0; i < 5; i++ {
+				result := sendToExtensionPort(context.Background(), client, port, ExtensionRequest{Type: "ask_continue", RequestID: "req"})
+				if result.Delivered != tt.delivered {
+					t.Fatalf("Delivered = %v, want %v", result.Delivered, tt.delivered)
+				}
+			}
+			if n := newConns.Load(); n != 1 {
+				t.Errorf("建立了 %d 个连接，响应体未释放导致连接无法复用", n)
+			}
+		})
+	}
+}
+
+func TestAskContinueUsesCustomResultTemplate(t *testing.T) {
+	startTestServer(t)
+	override(t, &resultTemplate, "USER: {userInput} / WHY: {reason}")
+	newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: "继续"}
+	})
+
+	text := resultText(callTool(t, askContinueHandler, map[string]any{"reason": "完成了"}))
+	if want := "USER: 继续 / WHY: 完成了"; text != want {
+		t.Errorf("结果 = %q, want %q", text, want)
+	}
+}
+
+func TestAskContinueSuppressReminder(t *testing.T) {
+	tests := []struct {
+		name         string
+		suppress     bool
+		template     string
+		wantReminder bool
+		wantPrefix   string
+	}{
+		{"default", false, "", true, "用户希望继续"},
+		{"suppressed", true, "", false, ""},
+		{"custom template wins", true, "USER: {userInput}", false, "USER: 部署"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			override(t, &suppressReminder, tt.suppress)
+			override(t, &resultTemplate, tt.template)
+			newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+				return &CallbackResponse{UserInput: "部署"}
+			})
+
+			text := resultText(callTool(t, askContinueHandler, map[string]any{"reason": "完成了", "language": "zh"}))
+			if got := strings.Contains(text, "强制提醒"); got != tt.wantReminder {
+				t.Errorf("结果中包含强制提醒 = %v, want %v:\n%s", got, tt.wantReminder, text)
+			}
+			if !strings.Contains(text, "部署") || !strings.HasPrefix(text, tt.wantPrefix) {
+				t.Errorf("结果 = %q, want prefix %q 且包含用户指令", text, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestAskContinuePlaceholder(t *testing.T) {
+	long := strings.Repeat("占", MaxPlaceholderRunes+10)
+	tests := []struct {
+		name  string
+		input any
+		want  string
+	}{
+		{"omitted", nil, ""},
+		{"passthrough", "例如：继续部署", "例如：继续部署"},
+		{"newlines collapsed", "  第一行\n\t第二行  ", "第一行 第二行"},
+		{"truncated", long, truncateRunes(long, MaxPlaceholderRunes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+				return &CallbackResponse{UserInput: "好"}
+			})
+
+			args := map[string]any{"reason": "完成了"}
+			if tt.input != nil {
+				args["placeholder"] = tt.input
+			}
+			callTool(t, askContinueHandler, args)
+			if got := ext.next(t).Placeholder; got != tt.want {
+				t.Errorf("Placeholder = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 死循环检测
+// ============================================================
+
+func TestDetectAskLoop(t *testing.T) {
+	override(t, &loopLimit, 3)
+	override(t, &lastLoopReason, "")
+	override(t, &loopRepeatCount, 0)
+
+	fast, slow := 100*time.Millisecond, AutoReplyThreshold
+	steps := []struct {
+		reason string
+		wait   time.Duration
+		want   bool
+	}{
+		{"a", fast, false},
+		{"a", fast, false},
+		{"b", fast, false}, // 原因变化，重新计数
+		{"b", fast, false},
+		{"b", slow, false}, // 真人回复，重置
+		{"b", fast, false},
+		{"b", fast, false},
+		{"b", fast, true},  // 连续第 3 次
+		{"b", fast, false}, // 触发后计数清零
+	}
+	for i, step := range steps {
+		if got := detectAskLoop(step.reason, step.wait); got != step.want {
+			t.Fatalf("第 %d 次 detectAskLoop(%q, %v) = %v, want %v", i+1, step.reason, step.wait, got, step.want)
+		}
+	}
+}
+
+func TestAskContinueBreaksAutoReplyLoop(t *testing.T) {
+	startTestServer(t)
+	override(t, &loopLimit, 2)
+	override(t, &lastLoopReason, "")
+	override(t, &loopRepeatCount, 0)
+	newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: "continue"}
+	})
+
+	args := map[string]any{"reason": "同一个原因", "language": "en"}
+	if text := resultText(callTool(t, askContinueHandler, args)); strings.Contains(text, "loop detected") {
+		t.Fatalf("第一次不应判定为死循环: %s", text)
+	}
+	if text := resultText(callTool(t, askContinueHandler, args)); !strings.Contains(text, "Conversation loop detected") {
+		t.Errorf("第二次自动回复应判定为死循环: %s", text)
+	}
+}
+
+// ============================================================
+// 请求 ID 与注册
+// ============================================================
+
+// resetPendingState 使用空的待处理请求表，测试结束时还原
+func resetPendingState(t *testing.T) {
+	t.Helper()
+	override(t, &pendingRequests, make(map[string]*PendingRequest))
+	override(t, &expectedRequests, make(map[string]time.Time))
+	override(t, &earlyResponses, make(map[string]any))
+	override(t, &orphanedRequests, make(map[string]string))
+	// 待处理请求文件在后台写入，等写完再清理临时目录
+	t.Cleanup(pendingStateWrites.Wait)
+}
+
+func TestReserveRequestIDUniqueUnderConcurrency(t *testing.T) {
+	resetPendingState(t)
+
+	const workers, perWorker = 16, 200
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				ids <- reserveRequestID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("重复的请求 ID: %s", id)
+		}
+		seen[id] = true
+	}
+	if len(expectedRequests) != workers*perWorker {
+		t.Errorf("预留了 %d 个 ID, want %d", len(expectedRequests), workers*perWorker)
+	}
+}
+
+func TestRegisterPendingRequestDoesNotOverwrite(t *testing.T) {
+	resetPendingState(t)
+
+	first := registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: reserveRequestID()})
+	second := registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: reserveRequestID()})
+	if len(pendingRequests) != 2 {
+		t.Fatalf("待处理请求数 = %d, want 2", len(pendingRequests))
+	}
+	for id, pending := range pendingRequests {
+		if pending.ch != first && pending.ch != second {
+			t.Errorf("请求 %s 的响应通道被替换", id)
+		}
+	}
+}
+
+func TestCallbackBeforeRegistrationIsDelivered(t *testing.T) {
+	base := startTestServer(t)
+	resetPendingState(t)
+
+	requestID := reserveRequestID()
+	if status := postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: requestID, UserInput: "早到的回复"}); status != http.StatusOK {
+		t.Fatalf("预留 ID 的回调状态码 = %d, want 200", status)
+	}
+	if status := postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: "req_unknown", UserInput: "x"}); status != http.StatusNotFound {
+		t.Errorf("未知 ID 的回调状态码 = %d, want 404", status)
+	}
+
+	ch := registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID})
+	select {
+	case result := <-ch:
+		if resp, ok := result.(CallbackResponse); !ok || resp.UserInput != "早到的回复" {
+			t.Errorf("注册后收到 %#v", result)
+		}
+	default:
+		t.Fatal("注册时没有立即投递早到的回调")
+	}
+	if _, pending := pendingRequests[requestID]; pending {
+		t.Error("已投递的请求不应留在待处理表中")
+	}
+}
+
+// 扩展重试回调时只有第一次生效，重复的回调返回 404，结果不会被覆盖
+func TestDuplicateCallbackIsRejected(t *testing.T) {
+	base := startTestServer(t)
+	tests := []struct {
+		name     string
+		register bool // 回调到达前是否已注册（否则只预留了 ID，回调暂存）
+	}{
+		{"registered", true},
+		{"early", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetPendingState(t)
+			requestID := reserveRequestID()
+			var ch chan any
+			if tt.register {
+				ch = registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID})
+			}
+
+			for i, want := range []int{http.StatusOK, http.StatusNotFound, http.StatusNotFound} {
+				input := fmt.Sprintf("第 %d 次回调", i+1)
+				if status := postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: requestID, UserInput: input}); status != want {
+					t.Errorf("%s 状态码 = %d, want %d", input, status, want)
+				}
+			}
+
+			if !tt.register {
+				ch = registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID})
+			}
+			select {
+			case result := <-ch:
+				if resp, ok := result.(CallbackResponse); !ok || resp.UserInput != "第 1 次回调" {
+					t.Errorf("投递的结果 = %#v, want 第一次回调", result)
+				}
+			default:
+				t.Fatal("第一次回调没有被投递")
+			}
+			if len(ch) != 0 {
+				t.Error("重复的回调被再次写入通道")
+			}
+		})
+	}
+}
+
+// ============================================================
+// 提示排队
+// ============================================================
+
+// 串行模式下第二个提示要等第一个得到回复后才发送给扩展
+func TestSerialPromptsQueue(t *testing.T) {
+	base := startTestServer(t)
+	override(t, &promptSlots, make(chan struct{}, 1))
+	ext := newFakeExtension(t, nil)
+
+	done := make(chan string, 2)
+	for _, reason := range []string{"第一个", "第二个"} {
+		go func(reason string) {
+			resp, err := requestUserInput(context.Background(), ExtensionRequest{Type: "ask_continue", Reason: reason})
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			done <- resp.UserInput
+		}(reason)
+	}
+
+	first := ext.next(t)
+	select {
+	case second := <-ext.requests:
+		t.Fatalf("第一个提示尚未结束，第二个提示 %q 就已发送", second.Reason)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: first.RequestID, UserInput: "answer 1"})
+	second := ext.next(t)
+	if second.Reason == first.Reason {
+		t.Fatalf("同一个提示被发送了两次: %q", first.Reason)
+	}
+	postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: second.RequestID, UserInput: "answer 2"})
+
+	got := []string{<-done, <-done}
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"answer 1", "answer 2"}) {
+		t.Errorf("结果 = %v", got)
+	}
+}
+
+// 最多同时显示 N 个提示：并发提问时扩展上显示的提示数从不超过上限，排队的提示最终都会显示
+func TestMaxVisiblePrompts(t *testing.T) {
+	const limit, asks = 2, 6
+	base := startTestServer(t)
+	override(t, &promptSlots, make(chan struct{}, limit))
+	ext := newFakeExtension(t, nil)
+
+	var visible, peak atomic.Int32
+	go func() {
+		for range asks {
+			req := <-ext.requests
+			n := visible.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				visible.Add(-1)
+				postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: req.RequestID, UserInput: req.Reason})
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := range asks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reason := fmt.Sprintf("提示 %d", i)
+			resp, err := requestUserInput(context.Background(), ExtensionRequest{Type: "ask_continue", Reason: reason})
+			if err != nil || resp.UserInput != reason {
+				t.Errorf("%s: resp = %+v, err = %v", reason, resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > limit {
+		t.Errorf("同时显示了 %d 个提示，上限为 %d", p, limit)
+	}
+}
+
+// ============================================================
+// 重试退避
+// ============================================================
+
+func TestRetryBackoffSchedule(t *testing.T) {
+	override(t, &retryInterval, 1)
+	override(t, &retryMaxInterval, 5)
+
+	tests := []struct {
+		attempt int
+		base    time.Duration // 不含抖动的间隔，抖动最多再加 20%
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			got := retryBackoff(tt.attempt)
+			if got < tt.base || got > tt.base+tt.base/5 {
+				t.Fatalf("retryBackoff(%d) = %v, want [%v, %v]", tt.attempt, got, tt.base, tt.base+tt.base/5)
+			}
+		}
+	}
+
+	override(t, &retryInterval, 0)
+	if got := retryBackoff(3); got != 0 {
+		t.Errorf("间隔为 0 时 retryBackoff = %v, want 0", got)
+	}
+}
+
+// 调用在退避等待中被取消时立即返回，不再继续重试
+func TestRetryBackoffObservesContext(t *testing.T) {
+	startTestServer(t)
+	resetPendingState(t)
+	override(t, &maxRetryCount, 5)
+	override(t, &retryInterval, 10)
+	override(t, &retryMaxInterval, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := requestUserInput(ctx, ExtensionRequest{Type: "ask_continue", Reason: "没有扩展"})
+	if err == nil || !strings.Contains(err.Error(), "调用已取消") {
+		t.Fatalf("requestUserInput() error = %v, want 调用已取消", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("取消后仍在退避等待，耗时 %v", elapsed)
+	}
+	pendingMutex.RLock()
+	defer pendingMutex.RUnlock()
+	if len(pendingRequests) != 0 {
+		t.Errorf("取消后仍有 %d 个待处理请求", len(pendingRequests))
+	}
+}
+
+// ============================================================
+// 原因改写
+// ============================================================
+
+func TestTransformReason(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("改写命令用例依赖 sh")
+	}
+	tests := []struct {
+		name     string
+		template string
+		command  string
+		want     string
+	}{
+		{"unchanged", "", "", "构建完成"},
+		{"template", "{reason}，是否继续？", "", "构建完成，是否继续？"},
+		{"command wins over template", "{reason}？", "sed 's/完成/成功/'", "构建成功"},
+		{"failing command falls back", "", "exit 3", "构建完成"},
+		{"empty output falls back", "", "true", "构建完成"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &reasonTemplate, tt.template)
+			override(t, &reasonCommand, tt.command)
+			if got := transformReason("构建完成"); got != tt.want {
+				t.Errorf("transformReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskContinueSendsRewrittenReason(t *testing.T) {
+	startTestServer(t)
+	override(t, &reasonTemplate, "{reason}，是否继续？")
+	ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: "好"}
+	})
+
+	callTool(t, askContinueHandler, map[string]any{"reason": "测试已通过"})
+	if sent := ext.next(t); sent.Reason != "测试已通过，是否继续？" {
+		t.Errorf("扩展收到的原因 = %q", sent.Reason)
+	}
+}
+
+// ============================================================
+// 回调服务器启动
+// ============================================================
+
+func TestServeCallback(t *testing.T) {
+	t.Run("serving before return", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := serveCallback(listener)
+		if err != nil {
+			t.Fatalf("serveCallback() error = %v", err)
+		}
+		defer srv.Close()
+
+		resp, err := http.Get("http://" + listener.Addr().String() + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("/health 状态码 = %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("serve fails immediately", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener.Close()
+
+		start := time.Now()
+		if _, err := serveCallback(listener); err == nil {
+			t.Fatal("监听器已关闭时 serveCallback 应返回错误")
+		}
+		if elapsed := time.Since(start); elapsed >= ServeStartTimeout {
+			t.Errorf("错误应同步返回，实际等待了 %v", elapsed)
+		}
+	})
+}
+
+// ============================================================
+// 应答窗口信息
+// ============================================================
+
+func TestFormatWindowSection(t *testing.T) {
+	m := messagesFor("en")
+	tests := []struct {
+		name   string
+		window *WindowInfo
+		want   string
+	}{
+		{"unknown", nil, ""},
+		{"port only", &WindowInfo{Port: 23983}, "Reply came from the window on port 23983\n\n"},
+		{"full", &WindowInfo{Port: 23983, PID: 42, Workspace: "/src/api", Details: "window 2"},
+			"Reply came from the window on port 23983 (PID 42, workspace /src/api)\nExtension note: window 2\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatWindowSection(m, tt.window); got != tt.want {
+				t.Errorf("formatWindowSection() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 应答窗口的 PID 来自端口文件，工作区优先使用回调中携带的值
+func TestAskContinueReportsAnsweringWindow(t *testing.T) {
+	startTestServer(t)
+	ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: "ok", Workspace: "/src/web"}
+	})
+
+	text := resultText(callTool(t, askContinueHandler, map[string]any{"reason": "r", "language": "en"}))
+	want := fmt.Sprintf("port %d (PID %d, workspace /src/web)", ext.port, os.Getpid())
+	if !strings.Contains(text, want) {
+		t.Errorf("结果中没有应答窗口 %q:\n%s", want, text)
+	}
+}
+
+func TestSendToExtensionPortDetails(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		delivered bool
+		details   string
+	}{
+		{"accepted with details", 200, `{"success":true,"details":"window 2"}`, true, "window 2"},
+		{"accepted without details", 200, `{"success":true}`, true, ""},
+		{"not accepted", 200, `{"success":false,"details":"busy"}`, false, ""},
+		{"extension error", 500, `{"error":"boom","details":"stack"}`, false, "stack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			port := srv.Listener.Addr().(*net.TCPAddr).Port
+			result := sendToExtensionPort(context.Background(), srv.Client(), port, ExtensionRequest{Type: "ask_continue", RequestID: "req"})
+			if result.Delivered != tt.delivered || result.Details != tt.details {
+				t.Errorf("sendToExtensionPort() = delivered %v details %q, want %v %q", result.Delivered, result.Details, tt.delivered, tt.details)
+			}
+		})
+	}
+}
+
+// 扩展端口返回重定向时不跟随，视为连接失败
+func TestSendToExtensionPortRefusesRedirect(t *testing.T) {
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			logs := captureLog(t, levelInfo)
+			var followed atomic.Int32
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				followed.Add(1)
+				json.NewEncoder(w).Encode(ExtensionResponse{Success: true})
+			}))
+			defer target.Close()
+			redirector := httptest.NewServer(http.RedirectHandler(target.URL+"/ask", status))
+			defer redirector.Close()
+
+			port := redirector.Listener.Addr().(*net.TCPAddr).Port
+			result := sendToExtensionPort(context.Background(), extensionClient, port, ExtensionRequest{Type: "ask_continue", RequestID: "req"})
+			if result.Delivered || result.Rejection != nil {
+				t.Errorf("重定向应视为连接失败: %+v", result)
+			}
+			if n := followed.Load(); n != 0 {
+				t.Errorf("跟随了重定向（目标收到 %d 次请求）", n)
+			}
+			if !strings.Contains(logs.String(), target.URL) {
+				t.Errorf("日志中没有重定向地址:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+// 扩展接收请求时附带的说明应出现在返回给 AI 的结果中
+func TestAskContinueReportsExtensionDetails(t *testing.T) {
+	startTestServer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ExtensionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(ExtensionResponse{Success: true, Details: "prompt shown in window 2"})
+		go postJSON(fmt.Sprintf("http://127.0.0.1:%d/response", req.CallbackPort), req.Token,
+			CallbackResponse{RequestID: req.RequestID, UserInput: "ok"})
+	}))
+	defer srv.Close()
+	writeTestPortFile(t, PortFile{Port: srv.Listener.Addr().(*net.TCPAddr).Port, PID: os.Getpid(), Time: 1})
+
+	text := resultText(callTool(t, askContinueHandler, map[string]any{"reason": "r", "language": "en"}))
+	if !strings.Contains(text, "Extension note: prompt shown in window 2") {
+		t.Errorf("结果中没有扩展说明:\n%s", text)
+	}
+}
+
+// ============================================================
+// 取消
+// ============================================================
+
+func TestCancelEndpoints(t *testing.T) {
+	base := startTestServer(t)
+	tests := []struct {
+		name       string
+		path       string
+		requestID  string // 为空表示使用已注册的请求
+		wantStatus int
+		cancelled  bool
+	}{
+		{"cancel known", "/cancel", "", http.StatusOK, true},
+		{"cancel unknown", "/cancel", "req_unknown", http.StatusNotFound, false},
+		{"cancel-all", "/cancel-all", "", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetPendingState(t)
+			requestID := reserveRequestID()
+			ch := registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID})
+			target := tt.requestID
+			if target == "" {
+				target = requestID
+			}
+
+			status := postJSON(base+tt.path, callbackToken, map[string]string{"requestId": target})
+			if status != tt.wantStatus {
+				t.Fatalf("状态码 = %d, want %d", status, tt.wantStatus)
+			}
+			select {
+			case result := <-ch:
+				if !tt.cancelled || result != errUserCancelled {
+					t.Errorf("请求收到 %v, want cancelled=%v", result, tt.cancelled)
+				}
+			default:
+				if tt.cancelled {
+					t.Error("请求没有被取消")
+				}
+			}
+		})
+	}
+}
+
+// 所有回调接口共用同样的请求检查：Content-Type、请求体大小，并都算作一次活动
+func TestCallbackEndpointsValidateRequests(t *testing.T) {
+	base := startTestServer(t)
+	override(t, &maxCallbackBytes, 64)
+	oversized := `{"requestId": "` + strings.Repeat("x", 64) + `"}`
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"form content type", "application/x-www-form-urlencoded", `{"requestId": "req_x"}`, http.StatusUnsupportedMediaType},
+		{"missing content type", "", `{"requestId": "req_x"}`, http.StatusUnsupportedMediaType},
+		{"body too large", "application/json", oversized, http.StatusRequestEntityTooLarge},
+	}
+	for _, path := range []string{"/response", "/cancel", "/cancel-all"} {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				resetPendingState(t)
+				advance := useFakeIdleClock(t)
+				advance(time.Hour)
+
+				req, _ := http.NewRequest("POST", base+path, strings.NewReader(tt.body))
+				req.Header.Set("X-Ask-Continue-Token", callbackToken)
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("状态码 = %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+				if _, expired := idleExpired(time.Minute); expired {
+					t.Error("回调请求应重置空闲计时")
+				}
+			})
+		}
+	}
+}
+
+// /cancel-all 与注册并发时，已预留 ID 的请求无论先后都必须收到取消（go test -race）
+func TestCancelAllRacesWithRegistration(t *testing.T) {
+	base := startTestServer(t)
+	resetPendingState(t)
+
+	const n = 50
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = reserveRequestID()
+	}
+
+	channels := make([]chan any, n)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channels[i] = registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: ids[i]})
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if status := postJSON(base+"/cancel-all", callbackToken, struct{}{}); status != http.StatusOK {
+			t.Errorf("状态码 = %d", status)
+		}
+	}()
+	wg.Wait()
+
+	for i, ch := range channels {
+		select {
+		case result := <-ch:
+			if result != errUserCancelled {
+				t.Errorf("请求 %s 收到 %v", ids[i], result)
+			}
+		default:
+			t.Errorf("请求 %s 没有收到取消", ids[i])
+		}
+	}
+}
+
+// ============================================================
+// reason_file
+// ============================================================
+
+func TestResolveReason(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	file := write("reason.md", []byte("\n  文件中的原因\n"))
+	tooLarge := write("large.md", bytes.Repeat([]byte("x"), MaxReasonFileBytes+1))
+	binary := write("binary.bin", []byte{0xff, 0xfe})
+
+	tests := []struct {
+		name       string
+		precedence string
+		reason     string
+		file       string
+		want       string
+		wantErr    string
+	}{
+		{"neither", "file", "", "", "任务已完成", ""},
+		{"inline only", "file", "内联原因", "", "内联原因", ""},
+		{"file only", "inline", "", file, "文件中的原因", ""},
+		{"both, file wins", "file", "内联原因", file, "文件中的原因", ""},
+		{"both, inline wins", "inline", "内联原因", file, "内联原因", ""},
+		{"both, concat", "concat", "内联原因", file, "内联原因\n\n文件中的原因", ""},
+		{"missing file", "inline", "内联原因", filepath.Join(dir, "missing.md"), "", "无法读取"},
+		{"directory", "file", "", dir, "", "不是普通文件"},
+		{"too large", "file", "", tooLarge, "", "过大"},
+		{"not utf-8", "file", "", binary, "", "UTF-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &reasonPrecedence, tt.precedence)
+			var request mcp.CallToolRequest
+			request.Params.Arguments = map[string]any{"reason": tt.reason, "reason_file": tt.file}
+
+			got, err := resolveReason(request)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveReason() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolveReason() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// /echo
+// ============================================================
+
+func TestEchoEndpoint(t *testing.T) {
+	base := startTestServer(t)
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"echoes json", "POST", "", `{"ping":1,"text":"你好"}`, http.StatusOK, `{"ping":1,"text":"你好"}`},
+		{"invalid json", "POST", "", `{"ping":`, http.StatusBadRequest, ""},
+		{"too large", "POST", "", `"` + strings.Repeat("x", MaxEchoBytes) + `"`, http.StatusRequestEntityTooLarge, ""},
+		{"get", "GET", "", "", http.StatusMethodNotAllowed, ""},
+		{"foreign origin", "POST", "https://evil.example", `{}`, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, base+"/echo", strings.NewReader(tt.body))
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("状态码 = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("响应 = %s, want %s", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 等待超时
+// ============================================================
+
+// 超时后按默认回复继续，移除请求并通知扩展关闭提示
+func TestAskContinueTimeoutUsesDefaultResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]any
+		want string
+	}{
+		{"default", map[string]any{}, "Default reply: continue"},
+		{"custom", map[string]any{"default_response": "  run the tests  "}, "Default reply: run the tests"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			resetPendingState(t)
+			dismissed := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					RequestID string `json:"requestId"`
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				if r.URL.Path == "/dismiss" {
+					dismissed <- body.RequestID
+				}
+				json.NewEncoder(w).Encode(ExtensionResponse{Success: true})
+			}))
+			defer srv.Close()
+			writeTestPortFile(t, PortFile{Port: srv.Listener.Addr().(*net.TCPAddr).Port, PID: os.Getpid(), Time: 1})
+
+			args := map[string]any{"reason": "r", "language": "en", "timeout_seconds": 1.0}
+			for k, v := range tt.args {
+				args[k] = v
+			}
+			text := resultText(callTool(t, askContinueHandler, args))
+			if !strings.Contains(text, "did not reply within 1 seconds") || !strings.Contains(text, tt.want) {
+				t.Errorf("超时结果 = %q, want %q", text, tt.want)
+			}
+			select {
+			case <-dismissed:
+			case <-time.After(5 * time.Second):
+				t.Error("超时后没有通知扩展关闭提示")
+			}
+			pendingMutex.Lock()
+			left := len(pendingRequests)
+			pendingMutex.Unlock()
+			if left != 0 {
+				t.Errorf("超时后仍有 %d 个待处理请求", left)
+			}
+		})
+	}
+}
+
+func TestAskContinueRejectsNegativeTimeout(t *testing.T) {
+	result := callTool(t, askContinueHandler, map[string]any{"reason": "r", "timeout_seconds": -1.0})
+	if !result.IsError || !strings.Contains(resultText(result), "timeout_seconds") {
+		t.Errorf("负数超时应返回参数错误: %q", resultText(result))
+	}
+}
+
+// ============================================================
+// 结果格式
+// ============================================================
+
+func TestContinueResultPrefixFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		flag bool
+		cont bool
+		want string
+	}{
+		{"off", false, true, "msg"},
+		{"continue", true, true, "CONTINUE: true\n\nmsg"},
+		{"stop", true, false, "CONTINUE: false\n\nmsg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &resultPrefixFlag, tt.flag)
+			override(t, &resultFormat, "text")
+			got := resultText(continueResult(AskResult{Continue: tt.cont, Message: "msg"}))
+			if got != tt.want {
+				t.Errorf("continueResult() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 等待心跳
+// ============================================================
+
+// 心跳日志只在 debug 级别输出，默认的 info 级别下不应刷屏
+func TestPendingHeartbeatLogsAtDebug(t *testing.T) {
+	tests := []struct {
+		level logLevel
+		want  bool
+	}{
+		{levelInfo, false},
+		{levelDebug, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			base := startTestServer(t)
+			override(t, &pendingHeartbeat, 10*time.Millisecond)
+			logs := captureLog(t, tt.level)
+			ext := newFakeExtension(t, nil)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := requestUserInput(context.Background(), ExtensionRequest{Type: "ask_continue", Reason: "r"})
+				done <- err
+			}()
+			req := ext.next(t)
+			time.Sleep(50 * time.Millisecond)
+			postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: req.RequestID, UserInput: "ok"})
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Contains(logs.String(), "已等待"); got != tt.want {
+				t.Errorf("%s 级别下输出心跳 = %v, want %v\n%s", tt.level, got, tt.want, logs.String())
+			}
+		})
+	}
+}
+
+// ============================================================
+// 扩展证书固定
+// ============================================================
+
+func TestParseCertPin(t *testing.T) {
+	sum := sha256.Sum256([]byte("cert"))
+	hexPin := hex.EncodeToString(sum[:])
+	var colon []string
+	for i := 0; i < len(hexPin); i += 2 {
+		colon = append(colon, strings.ToUpper(hexPin[i:i+2]))
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{"lower hex", hexPin, false},
+		{"colon separated upper", " " + strings.Join(colon, ":") + " ", false},
+		{"too short", hexPin[:62], true},
+		{"not hex", strings.Repeat("zz", 32), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pin, err := parseCertPin(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCertPin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(pin, sum[:]) {
+				t.Errorf("parseCertPin() = %x, want %x", pin, sum)
+			}
+		})
+	}
+}
+
+func TestPinnedExtensionCert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ExtensionResponse{Success: true})
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	match := sha256.Sum256(srv.Certificate().Raw)
+	mismatch := sha256.Sum256([]byte("another certificate"))
+
+	tests := []struct {
+		name      string
+		pin       []byte
+		delivered bool
+	}{
+		{"match", match[:], true},
+		{"mismatch", mismatch[:], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := extensionClient.Transport.(*http.Transport)
+			override(t, &transport.TLSClientConfig, transport.TLSClientConfig)
+			override(t, &extCertPin, tt.pin)
+			pinExtensionCert(tt.pin)
+			t.Cleanup(transport.CloseIdleConnections)
+
+			result := sendToExtensionPort(context.Background(), extensionClient, port, ExtensionRequest{Type: "ask_continue", RequestID: "req"})
+			if result.Delivered != tt.delivered {
+				t.Errorf("Delivered = %v, want %v", result.Delivered, tt.delivered)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 回调来源限制
+// ============================================================
+
+func TestIsLocalOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"http://localhost:3000", true},
+		{"https://127.0.0.1", true},
+		{"http://[::1]:8080", true},
+		{"vscode-webview://abc", false},
+		{"http://localhost.evil.com", false},
+		{"https://example.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := isLocalOrigin(tt.origin); got != tt.want {
+			t.Errorf("isLocalOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCallbackOriginCheck(t *testing.T) {
+	base := startTestServer(t)
+	resetPendingState(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantStatus int
+		wantACAO   string
+	}{
+		{"no origin (extension)", "POST", "", http.StatusNotFound, ""},
+		{"local page", "POST", "http://localhost:5173", http.StatusNotFound, "http://localhost:5173"},
+		{"foreign page", "POST", "https://evil.example", http.StatusForbidden, ""},
+		{"local preflight", "OPTIONS", "http://127.0.0.1:5173", http.StatusOK, "http://127.0.0.1:5173"},
+		{"foreign preflight", "OPTIONS", "https://evil.example", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, base+"/response", strings.NewReader(`{"requestId":"req_none"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Ask-Continue-Token", callbackToken)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			// 通过来源检查的回调找不到请求，返回 404
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("状态码 = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.wantACAO {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantACAO)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 回调令牌
+// ============================================================
+
+func TestCallbackToken(t *testing.T) {
+	base := startTestServer(t)
+	resetPendingState(t)
+
+	tests := []struct {
+		name       string
+		token      string
+		legacy     bool
+		wantStatus int
+	}{
+		{"missing token", "", false, http.StatusUnauthorized},
+		{"wrong token", "not-the-token", false, http.StatusUnauthorized},
+		{"correct token", callbackToken, false, http.StatusOK},
+		{"legacy extension without token", "", true, http.StatusOK},
+		{"wrong token even in legacy mode", "not-the-token", true, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			override(t, &allowLegacyCallbacks, tt.legacy)
+			requestID := reserveRequestID()
+			ch := registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID})
+			t.Cleanup(func() { removePendingRequest(requestID) })
+
+			status := postJSON(base+"/response", tt.token, CallbackResponse{RequestID: requestID, UserInput: "伪造的输入"})
+			if status != tt.wantStatus {
+				t.Fatalf("状态码 = %d, want %d", status, tt.wantStatus)
+			}
+			delivered := len(ch) > 0
+			if want := tt.wantStatus == http.StatusOK; delivered != want {
+				t.Errorf("回调已投递 = %v, want %v", delivered, want)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 扩展拒绝时缩短原因
+// ============================================================
+
+func TestShortenedReasons(t *testing.T) {
+	long := strings.Repeat("长", 100)
+	tests := []struct {
+		name   string
+		reason string
+		want   []string
+	}{
+		{"single line", "完成", []string{"完成"}},
+		{"paragraphs", "标题\n细节\n\n第二段", []string{"标题\n细节\n\n第二段", "标题\n细节", "标题"}},
+		{"long title truncated", long + "\n\n更多", []string{long + "\n\n更多", long, truncateRunes(long, 80)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shortenedReasons(tt.reason); !slices.Equal(got, tt.want) {
+				t.Errorf("shortenedReasons() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 扩展以 413 拒绝过长的原因时逐级缩短重试，直到被接受
+func TestRequestUserInputShortensRejectedReason(t *testing.T) {
+	base := startTestServer(t)
+	reasons := make(chan string, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ExtensionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		reasons <- req.Reason
+		if utf8.RuneCountInString(req.Reason) > 10 {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		json.NewEncoder(w).Encode(ExtensionResponse{Success: true})
+		go postJSON(base+"/response", req.Token, CallbackResponse{RequestID: req.RequestID, UserInput: "ok"})
+	}))
+	defer srv.Close()
+	writeTestPortFile(t, PortFile{Port: srv.Listener.Addr().(*net.TCPAddr).Port, PID: os.Getpid(), Time: 1})
+
+	reason := "构建失败\n\n" + strings.Repeat("日志", 50)
+	resp, err := requestUserInput(context.Background(), ExtensionRequest{Type: "ask_continue", Reason: reason})
+	if err != nil {
+		t.Fatalf("requestUserInput() error = %v", err)
+	}
+	if resp.UserInput != "ok" {
+		t.Errorf("UserInput = %q", resp.UserInput)
+	}
+	close(reasons)
+	var sent []string
+	for r := range reasons {
+		sent = append(sent, r)
+	}
+	if want := []string{reason, "构建失败"}; !slices.Equal(sent, want) {
+		t.Errorf("发送的原因依次为 %q, want %q", sent, want)
+	}
+}
+
+// ============================================================
+// 取消视为继续
+// ============================================================
+
+// askJSON 以 JSON 结果格式调用 ask_continue 并解析结果
+func askJSON(t *testing.T, args map[string]any) AskResult {
+	t.Helper()
+	override(t, &resultFormat, "json")
+	var result AskResult
+	text := resultText(callTool(t, askContinueHandler, args))
+	if err := json.Unmarshal([]byte(text), &result); err != nil {
+		t.Fatalf("结果不是 JSON: %v\n%s", err, text)
+	}
+	return result
+}
+
+// ============================================================
+// patch 识别
+// ============================================================
+
+func TestLooksLikePatch(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"git diff", "diff --git a/main.go b/main.go\n--- a/main.go\n+++ b/main.go", true},
+		{"unified diff with leading blank lines", "\n\n--- a/x\n+++ b/x\n@@ -1 +1 @@", true},
+		{"plus header first", "+++ b/x\n", true},
+		{"plain instruction", "继续，顺便修一下 diff 的显示", false},
+		{"markdown rule", "---\n标题", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikePatch(tt.text); got != tt.want {
+				t.Errorf("looksLikePatch(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskContinueReturnsPatch(t *testing.T) {
+	const patch = "--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@\n-old\n+new"
+	tests := []struct {
+		name   string
+		detect bool
+		input  string
+		want   string
+	}{
+		{"patch", true, patch, patch},
+		{"detection off", false, patch, ""},
+		{"not a patch", true, "继续", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			override(t, &detectPatch, tt.detect)
+			newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+				return &CallbackResponse{UserInput: tt.input}
+			})
+
+			result := askJSON(t, map[string]any{"reason": "r"})
+			if result.Patch != tt.want {
+				t.Errorf("Patch = %q, want %q", result.Patch, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelAsDefault(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		instruction string
+		wantCont    bool
+		wantMessage string
+	}{
+		{"disabled", false, "", false, ""},
+		{"default instruction", true, "", true, messagesFor("en").CancelInstruction},
+		{"custom instruction", true, "按计划继续", true, "按计划继续"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			override(t, &cancelAsDefault, tt.enabled)
+			override(t, &cancelDefaultInstruction, tt.instruction)
+			newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+				return &CallbackResponse{Cancelled: true}
+			})
+
+			result := askJSON(t, map[string]any{"reason": "r", "language": "en"})
+			if !result.Cancelled || result.Continue != tt.wantCont {
+				t.Errorf("cancelled = %v, continue = %v, want true, %v", result.Cancelled, result.Continue, tt.wantCont)
+			}
+			if tt.wantMessage != "" && !strings.Contains(result.Message, tt.wantMessage) {
+				t.Errorf("message = %q, want it to contain %q", result.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+// ============================================================
+// 图片回复
+// ============================================================
+
+func TestValidateCallbackImages(t *testing.T) {
+	small := CallbackImage{MimeType: "image/png", Data: base64.StdEncoding.EncodeToString([]byte("png"))}
+	huge := CallbackImage{MimeType: "image/png", Data: strings.Repeat("A", MaxImageBytes/3*4+8)}
+	tests := []struct {
+		name    string
+		images  []CallbackImage
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"within limits", []CallbackImage{small, small, small}, false},
+		{"too many", slices.Repeat([]CallbackImage{small}, MaxImageCount+1), true},
+		{"too large", []CallbackImage{huge}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateCallbackImages(tt.images); (err != nil) != tt.wantErr {
+				t.Errorf("validateCallbackImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAskContinueReturnsImageContent(t *testing.T) {
+	base := startTestServer(t)
+	screenshot := base64.StdEncoding.EncodeToString([]byte("\x89PNG fake"))
+	newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: "看截图", Images: []CallbackImage{{MimeType: "image/png", Data: screenshot}}}
+	})
+
+	result := callTool(t, askContinueHandler, map[string]any{"reason": "r"})
+	var images []mcp.ImageContent
+	for _, content := range result.Content {
+		if image, ok := content.(mcp.ImageContent); ok {
+			images = append(images, image)
+		}
+	}
+	if len(images) != 1 || images[0].Data != screenshot || images[0].MIMEType != "image/png" {
+		t.Errorf("图片内容 = %+v", images)
+	}
+
+	// 超出数量限制的回调被拒绝，扩展据此提示用户
+	tooMany := slices.Repeat([]CallbackImage{{MimeType: "image/png", Data: screenshot}}, MaxImageCount+1)
+	if status := postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: "req_x", Images: tooMany}); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("图片过多时状态码 = %d, want 413", status)
+	}
+}
+
+// ============================================================
+// 诊断转储
+// ============================================================
+
+func TestDebugDumpGating(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			override(t, &debugEndpoints, enabled)
+			base := startTestServer(t)
+			resetPendingState(t)
+			requestID := reserveRequestID()
+			registerPendingRequest(ExtensionRequest{Type: "ask_select", RequestID: requestID, Reason: "选哪个"})
+
+			resp, err := http.Get(base + "/debug/dump")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if !enabled {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("未开启时状态码 = %d, want 404", resp.StatusCode)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("状态码 = %d, want 200", resp.StatusCode)
+			}
+			for _, want := range []string{"=== pending requests (1) ===", requestID + " type=ask_select", "=== goroutines"} {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("转储中缺少 %q", want)
+				}
+			}
+		})
+	}
+}
+
+// ============================================================
+// 非目标窗口的回复
+// ============================================================
+
+// 回复仍按 requestId 投递，只有应答窗口与送达窗口不同时才记录警告
+func TestForeignWindowReplyWarns(t *testing.T) {
+	tests := []struct {
+		name      string
+		replyPort int
+		wantWarn  bool
+	}{
+		{"same window", 40010, false},
+		{"old extension without port", 0, false},
+		{"another window", 40020, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := startTestServer(t)
+			resetPendingState(t)
+			logs := captureLog(t, levelWarn)
+			requestID := reserveRequestID()
+			ch := registerPendingRequest(ExtensionRequest{Type: "ask_continue", RequestID: requestID})
+			markRequestDelivered(requestID, 40010)
+
+			status := postJSON(base+"/response", callbackToken, CallbackResponse{RequestID: requestID, UserInput: "ok", Port: tt.replyPort})
+			if status != http.StatusOK || len(ch) != 1 {
+				t.Fatalf("状态码 = %d，已投递 = %v", status, len(ch) == 1)
+			}
+			if got := strings.Contains(logs.String(), "却由端口"); got != tt.wantWarn {
+				t.Errorf("记录警告 = %v, want %v: %s", got, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// ============================================================
+// 会话统计：ask 次数、等待时长、取消率
+// ============================================================
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// askOutcome 一次 requestUserInput 的结果分类
+type askOutcome int
+
+const (
+	outcomeAnswered  askOutcome = iota // 用户已回复
+	outcomeCancelled                   // 用户取消或调用被取消
+	outcomeFailed                      // 无法连接扩展等失败
+)
+
+// StatsSnapshot 统计快照
+type StatsSnapshot struct {
+	StartTime       time.Time
+	Asks            int64            // 总请求数
+	Answered        int64            // 用户已回复
+	Cancelled       int64            // 被取消
+	ConnectFailures int64            // 连接失败
+	TotalWait       time.Duration    // 所有请求的累计等待时长
+	Callbacks       int64            // 收到的回调数
+	UnknownCalls    int64            // 找不到对应请求的回调数
+	WaitBuckets     []int64          // 用户回复耗时直方图，与 waitBucketBounds 一一对应（累计计数）
+	AnsweredWait    time.Duration    // 已回复请求的累计等待时长
+	ByCategory      map[string]int64 // 按询问原因分类的请求数（未指定分类的不计入）
+}
+
+// waitBucketBounds 回复耗时直方图的上界（秒）
+var waitBucketBounds = []float64{1, 5, 15, 60, 300, 900, 3600}
+
+// AverageWait 平均等待时长
+func (s StatsSnapshot) AverageWait() time.Duration {
+	if s.Asks == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Asks)
+}
+
+var (
+	statsMutex sync.Mutex
+	stats      = StatsSnapshot{
+		StartTime:   serverStartTime,
+		WaitBuckets: make([]int64, len(waitBucketBounds)),
+		ByCategory:  make(map[string]int64),
+	}
+)
+
+// recordAsk 记录一次请求的结果，requestUserInput 的所有返回路径都会调用
+func recordAsk(outcome askOutcome, wait time.Duration, category string) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	stats.Asks++
+	if category != "" {
+		stats.ByCategory[category]++
+	}
+	stats.TotalWait += wait
+	switch outcome {
+	case outcomeAnswered:
+		stats.Answered++
+		stats.AnsweredWait += wait
+		for i, bound := range waitBucketBounds {
+			if wait.Seconds() <= bound {
+				stats.WaitBuckets[i]++
+			}
+		}
+	case outcomeCancelled:
+		stats.Cancelled++
+	case outcomeFailed:
+		stats.ConnectFailures++
+	}
+}
+
+// recordCallback 记录一次回调，known 表示是否找到了对应的请求
+func recordCallback(known bool) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	stats.Callbacks++
+	if !known {
+		stats.UnknownCalls++
+	}
+}
+
+func statsSnapshot() StatsSnapshot {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	snap := stats
+	snap.WaitBuckets = append([]int64(nil), stats.WaitBuckets...)
+	snap.ByCategory = maps.Clone(stats.ByCategory)
+	return snap
+}
+
+// ============================================================
+// 状态摘要日志：长时间运行时按固定间隔输出一行概况，不依赖指标系统
+// ============================================================
+func startStatusHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			logStatusSummary()
+		}
+	}()
+}
+
+func logStatusSummary() {
+	snap := statsSnapshot()
+	pendingMutex.RLock()
+	pendingCount := len(pendingRequests)
+	pendingMutex.RUnlock()
+
+	uptime := time.Since(snap.StartTime).Round(time.Second)
+	lastPort := lastDeliveredPort()
+	withFields("uptime", uptime.String(), "asks", snap.Asks, "pending", pendingCount, "lastPort", lastPort).
+		infof("状态: 已运行 %s，累计请求 %d，等待中 %d，最近送达端口 %d", uptime, snap.Asks, pendingCount, lastPort)
+}
+
+// logStatsDump 输出完整的统计计数（SIGUSR1 触发）
+func logStatsDump() {
+	logStatusSummary()
+	snap := statsSnapshot()
+	withFields("answered", snap.Answered, "cancelled", snap.Cancelled, "connectFailures", snap.ConnectFailures,
+		"callbacks", snap.Callbacks, "unknownCallbacks", snap.UnknownCalls).
+		infof("统计: 已回复 %d，已取消 %d，连接失败 %d，回调 %d（未知请求 %d），平均等待 %s",
+			snap.Answered, snap.Cancelled, snap.ConnectFailures, snap.Callbacks, snap.UnknownCalls,
+			snap.AverageWait().Round(time.Second))
+}
+
+// ============================================================
+// /metrics：Prometheus 文本格式的指标
+// ============================================================
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snap := statsSnapshot()
+	pendingMutex.RLock()
+	pendingCount := len(pendingRequests)
+	pendingMutex.RUnlock()
+
+	var sb strings.Builder
+	writeMetric := func(name, kind, help string, value any) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	writeMetric("ask_continue_asks_total", "counter", "Total ask requests.", snap.Asks)
+	writeMetric("ask_continue_answered_total", "counter", "Requests answered by the user.", snap.Answered)
+	writeMetric("ask_continue_cancelled_total", "counter", "Requests cancelled by the user or client.", snap.Cancelled)
+	writeMetric("ask_continue_connect_failures_total", "counter", "Requests that could not reach the extension.", snap.ConnectFailures)
+	writeMetric("ask_continue_callbacks_total", "counter", "Callbacks received on /response.", snap.Callbacks)
+	writeMetric("ask_continue_callbacks_unknown_total", "counter", "Callbacks for unknown request IDs.", snap.UnknownCalls)
+	writeMetric("ask_continue_pending", "gauge", "Requests currently waiting for the user.", pendingCount)
+	writeMetric("ask_continue_uptime_seconds", "gauge", "Server uptime in seconds.", int64(time.Since(snap.StartTime).Seconds()))
+
+	sb.WriteString("# HELP ask_continue_asks_by_category_total Ask requests by category.\n")
+	sb.WriteString("# TYPE ask_continue_asks_by_category_total counter\n")
+	for _, category := range askCategories {
+		fmt.Fprintf(&sb, "ask_continue_asks_by_category_total{category=%q} %d\n", category, snap.ByCategory[category])
+	}
+
+	sb.WriteString("# HELP ask_continue_response_seconds Time until the user answered.\n")
+	sb.WriteString("# TYPE ask_continue_response_seconds histogram\n")
+	for i, bound := range waitBucketBounds {
+		fmt.Fprintf(&sb, "ask_continue_response_seconds_bucket{le=\"%g\"} %d\n", bound, snap.WaitBuckets[i])
+	}
+	fmt.Fprintf(&sb, "ask_continue_response_seconds_bucket{le=\"+Inf\"} %d\n", snap.Answered)
+	fmt.Fprintf(&sb, "ask_continue_response_seconds_sum %g\n", snap.AnsweredWait.Seconds())
+	fmt.Fprintf(&sb, "ask_continue_response_seconds_count %d\n", snap.Answered)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(sb.String()))
+}
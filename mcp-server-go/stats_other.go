@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// watchStatsSignal 非 Unix 平台没有 SIGUSR1，统计请使用 /metrics 或 conversation_stats
+func watchStatsSignal() {}
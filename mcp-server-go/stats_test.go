@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedStats 用已知的计数替换全局统计，测试结束时还原
+func fixedStats(t *testing.T) {
+	t.Helper()
+	override(t, &stats, StatsSnapshot{
+		StartTime:       time.Now().Add(-90 * time.Minute),
+		Asks:            7,
+		Answered:        4,
+		Cancelled:       2,
+		ConnectFailures: 1,
+		TotalWait:       7 * time.Minute,
+		Callbacks:       5,
+		UnknownCalls:    1,
+		WaitBuckets:     make([]int64, len(waitBucketBounds)),
+		ByCategory:      map[string]int64{},
+	})
+	override(t, &lastPort, 23985)
+	resetPendingState(t)
+	pendingRequests["req_a"] = &PendingRequest{CreatedAt: time.Now()}
+	pendingRequests["req_b"] = &PendingRequest{CreatedAt: time.Now()}
+}
+
+func TestLogStatusSummary(t *testing.T) {
+	fixedStats(t)
+
+	t.Run("text", func(t *testing.T) {
+		logs := captureLog(t, levelInfo)
+		logStatusSummary()
+		want := "状态: 已运行 1h30m0s，累计请求 7，等待中 2，最近送达端口 23985"
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("日志 = %q, want %q", logs.String(), want)
+		}
+	})
+
+	t.Run("json fields", func(t *testing.T) {
+		logs := captureLog(t, levelInfo)
+		override(t, &jsonLogs, true)
+		logStatusSummary()
+
+		var entry struct {
+			Uptime   string `json:"uptime"`
+			Asks     int    `json:"asks"`
+			Pending  int    `json:"pending"`
+			LastPort int    `json:"lastPort"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(logs.String())), &entry); err != nil {
+			t.Fatalf("日志不是 JSON: %v\n%s", err, logs.String())
+		}
+		if entry.Uptime != "1h30m0s" || entry.Asks != 7 || entry.Pending != 2 || entry.LastPort != 23985 {
+			t.Errorf("日志字段 = %+v", entry)
+		}
+	})
+
+	t.Run("hidden at warn level", func(t *testing.T) {
+		logs := captureLog(t, levelWarn)
+		logStatusSummary()
+		if logs.String() != "" {
+			t.Errorf("warn 级别下不应输出状态摘要: %q", logs.String())
+		}
+	})
+}
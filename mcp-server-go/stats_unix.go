@@ -0,0 +1,23 @@
+//go:build unix
+
+// ============================================================
+// SIGUSR1：把当前统计输出到日志（仅 Unix）
+// 不需要开放 HTTP 接口，kill -USR1 <pid> 即可查看
+// ============================================================
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func watchStatsSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		for range sigCh {
+			logStatsDump()
+		}
+	}()
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// kill -USR1 输出状态摘要和完整的统计计数
+func TestStatsSignalDumpsStats(t *testing.T) {
+	fixedStats(t)
+	logs := captureLog(t, levelInfo)
+	watchStatsSignal()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"累计请求 7，等待中 2",
+		"统计: 已回复 4，已取消 2，连接失败 1，回调 5（未知请求 1），平均等待 1m0s",
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), want[1]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("收到 SIGUSR1 后没有输出统计:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range want {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("日志中缺少 %q:\n%s", line, logs.String())
+		}
+	}
+}
@@ -0,0 +1,1612 @@
+// ============================================================
+// 扩展工具：ask_continue 之外的交互工具
+// ============================================================
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// ============================================================
+// 工具限制
+// ============================================================
+const (
+	MaxSelectOptions  = 20 // ask_select 最多选项数
+	MaxBatchQuestions = 10 // ask_batch 最多问题数
+
+	MaxQuickReplies     = 6  // 快捷回复最多个数
+	MaxQuickReplyLength = 60 // 单个快捷回复最多字符数
+
+	MaxDiffBytes = 64 << 10 // ask_diff_approval 发送给扩展的 diff 最大字节数，超出截断
+
+	MaxAttachmentBytes = 200 << 10 // ask_continue 附件内容合计最大字节数，超出按比例截断
+
+	MaxCheckInDelay  = 2 * time.Hour // schedule_check_in 最长延迟
+	NotifyRetryCount = 2             // notify 最多尝试次数（无需等待用户，重试更少）
+
+	StatusProbeTimeout = time.Second // extension_status 每个端口的探测超时
+)
+
+// ============================================================
+// 参数解析辅助函数
+// ============================================================
+func argString(request mcp.CallToolRequest, key string) string {
+	if request.Params.Arguments == nil {
+		return ""
+	}
+	if v, ok := request.Params.Arguments[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// argInt 读取数字参数（JSON 数字解码为 float64），缺失或类型不符时 ok 为 false
+func argInt(request mcp.CallToolRequest, key string) (int, bool) {
+	if request.Params.Arguments == nil {
+		return 0, false
+	}
+	if v, ok := request.Params.Arguments[key].(float64); ok {
+		return int(v), true
+	}
+	return 0, false
+}
+
+func argBool(request mcp.CallToolRequest, key string) bool {
+	if request.Params.Arguments == nil {
+		return false
+	}
+	if v, ok := request.Params.Arguments[key].(bool); ok {
+		return v
+	}
+	return false
+}
+
+// argOptionalBool 读取布尔参数，缺失或类型不符时 ok 为 false，调用方据此使用默认值
+func argOptionalBool(request mcp.CallToolRequest, key string) (value, ok bool) {
+	if request.Params.Arguments == nil {
+		return false, false
+	}
+	value, ok = request.Params.Arguments[key].(bool)
+	return value, ok
+}
+
+// argStringSlice 读取字符串数组参数，非字符串元素返回错误
+func argStringSlice(request mcp.CallToolRequest, key string) ([]string, error) {
+	if request.Params.Arguments == nil {
+		return nil, nil
+	}
+	raw, ok := request.Params.Arguments[key]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	items, ok := raw.([]any)
+	if !ok {
+		return nil, argError("notStringArray", key)
+	}
+
+	values := make([]string, 0, len(items))
+	for i, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return nil, argError("itemNotString", key, i+1)
+		}
+		values = append(values, str)
+	}
+	return values, nil
+}
+
+// ============================================================
+// ask_select：让用户从选项列表中选择
+// ============================================================
+func newAskSelectTool() mcp.Tool {
+	return mcp.NewTool("ask_select",
+		mcp.WithDescription("向用户展示一组选项（例如多种实现方案），等待用户选择其中一个并返回选中的选项。"),
+		mcp.WithString("question",
+			mcp.Required(),
+			mcp.Description("要询问用户的问题"),
+		),
+		mcp.WithArray("options",
+			mcp.Required(),
+			mcp.Description(fmt.Sprintf("供用户选择的选项列表（1-%d 项，不能为空字符串或重复）", MaxSelectOptions)),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithBoolean("allow_custom",
+			mcp.Description("是否允许用户输入选项之外的自定义回答"),
+		),
+	)
+}
+
+func askSelectHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	question := argString(request, "question")
+	if question == "" {
+		return mcp.NewToolResultError("参数 question 不能为空"), nil
+	}
+
+	options, err := argStringSlice(request, "options")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	if err := validateSelectOptions(options); err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	allowCustom := argBool(request, "allow_custom")
+
+	infof("ask_select 被调用，问题: %s，选项数: %d", question, len(options))
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_select",
+		Reason:         question,
+		Options:        options,
+		AllowCustom:    allowCustom,
+		fallbackReason: selectFallbackReason(question, options, allowCustom),
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取用户选择: %s\n\n【注意】请在回复中直接询问用户。", err.Error())), nil
+	}
+
+	return mcp.NewToolResultText(formatSelectResult(resp, options, allowCustom)), nil
+}
+
+func validateSelectOptions(options []string) error {
+	if len(options) == 0 {
+		return fmt.Errorf("参数 options 不能为空")
+	}
+	if len(options) > MaxSelectOptions {
+		return fmt.Errorf("选项过多（%d 项），最多 %d 项", len(options), MaxSelectOptions)
+	}
+	seen := make(map[string]int, len(options))
+	for i, opt := range options {
+		if strings.TrimSpace(opt) == "" {
+			return fmt.Errorf("第 %d 个选项为空", i+1)
+		}
+		// 重复的选项无法按原文对应到唯一的编号
+		if j, ok := seen[opt]; ok {
+			return fmt.Errorf("第 %d 个选项与第 %d 个重复: %s", i+1, j+1, opt)
+		}
+		seen[opt] = i
+	}
+	return nil
+}
+
+// selectFallbackReason 生成旧版扩展使用的纯文本提问
+func selectFallbackReason(question string, options []string, allowCustom bool) string {
+	var sb strings.Builder
+	sb.WriteString(question)
+	sb.WriteString("\n\n请输入选项编号：\n")
+	for i, opt := range options {
+		fmt.Fprintf(&sb, "%d. %s\n", i+1, opt)
+	}
+	if allowCustom {
+		sb.WriteString("\n也可以直接输入自定义回答。")
+	}
+	return sb.String()
+}
+
+// formatSelectResult 将回调结果解析为选中的选项
+func formatSelectResult(resp *CallbackResponse, options []string, allowCustom bool) string {
+	index := -1
+	if resp.SelectedIndex != nil {
+		index = *resp.SelectedIndex
+	} else {
+		// 降级模式：用户输入的是编号或选项原文
+		input := strings.TrimSpace(resp.UserInput)
+		if n, err := strconv.Atoi(input); err == nil {
+			index = n - 1
+		} else {
+			for i, opt := range options {
+				if input == opt {
+					index = i
+					break
+				}
+			}
+		}
+	}
+
+	if index >= 0 && index < len(options) {
+		result := fmt.Sprintf("用户选择了选项 %d：%s", index+1, options[index])
+		if resp.SelectedIndex != nil && strings.TrimSpace(resp.UserInput) != "" {
+			result += fmt.Sprintf("\n\n补充说明：\n%s", resp.UserInput)
+		}
+		return result
+	}
+
+	if resp.UserInput == "" {
+		return "用户没有选择任何选项。"
+	}
+	if allowCustom {
+		return fmt.Sprintf("用户没有选择预设选项，输入了自定义回答：\n\n%s", resp.UserInput)
+	}
+	return fmt.Sprintf("用户的回答不匹配任何选项：\n\n%s\n\n请根据用户的回答自行判断。", resp.UserInput)
+}
+
+// ============================================================
+// ask_secret：获取密码、API Key 等敏感输入
+// 注意：用户输入的内容绝不能写入日志
+// ============================================================
+func newAskSecretTool() mcp.Tool {
+	return mcp.NewTool("ask_secret",
+		mcp.WithDescription("向用户索取密码、API Key 等敏感信息。输入框会被遮盖，内容不会写入日志。"),
+		mcp.WithString("prompt",
+			mcp.Required(),
+			mcp.Description("说明需要什么敏感信息以及用途"),
+		),
+		mcp.WithBoolean("redact_in_result",
+			mcp.Description("为 true 时结果中只返回确认信息（如长度），不返回原始值"),
+		),
+	)
+}
+
+func askSecretHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	prompt := argString(request, "prompt")
+	if prompt == "" {
+		return mcp.NewToolResultError("参数 prompt 不能为空"), nil
+	}
+	redact := argBool(request, "redact_in_result")
+
+	infof("ask_secret 被调用，提示: %s", prompt)
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_secret",
+		Reason:         prompt,
+		Masked:         true,
+		fallbackReason: prompt + "\n\n⚠️ 当前扩展版本不支持隐藏输入，输入内容将以明文显示。",
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取敏感信息: %s", err.Error())), nil
+	}
+
+	secret := resp.UserInput
+	if secret == "" {
+		return mcp.NewToolResultText("用户没有提供该信息。"), nil
+	}
+
+	length := len([]rune(secret))
+	if redact {
+		return mcp.NewToolResultText(fmt.Sprintf("已收到长度为 %d 的敏感信息（内容已隐藏）。", length)), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf(
+		"用户提供了敏感信息（长度 %d）：\n\n%s\n\n请仅在必要时使用该值，不要在回复中复述。",
+		length, secret,
+	)), nil
+}
+
+// ============================================================
+// ask_file：让用户选择文件或文件夹
+// ============================================================
+func newAskFileTool() mcp.Tool {
+	return mcp.NewTool("ask_file",
+		mcp.WithDescription("打开文件/文件夹选择器，让用户选择路径，返回选中项的绝对路径。"),
+		mcp.WithString("prompt",
+			mcp.Required(),
+			mcp.Description("说明需要用户选择什么"),
+		),
+		mcp.WithString("mode",
+			mcp.Description("选择模式：file（单个文件）、folder（文件夹）、files（多个文件），默认 file"),
+			mcp.Enum("file", "folder", "files"),
+		),
+		mcp.WithArray("filters",
+			mcp.Description("可选：文件过滤规则，例如 [\"*.go\", \"*.md\"]"),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+	)
+}
+
+func askFileHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	prompt := argString(request, "prompt")
+	if prompt == "" {
+		return mcp.NewToolResultError("参数 prompt 不能为空"), nil
+	}
+
+	mode := argString(request, "mode")
+	switch mode {
+	case "":
+		mode = "file"
+	case "file", "folder", "files":
+	default:
+		return mcp.NewToolResultError(fmt.Sprintf("不支持的 mode: %s（可选 file / folder / files）", mode)), nil
+	}
+
+	filters, err := argStringSlice(request, "filters")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	infof("ask_file 被调用，提示: %s，模式: %s", prompt, mode)
+
+	fallback := prompt + "\n\n请输入绝对路径"
+	if mode == "files" {
+		fallback += "（多个路径每行一个）"
+	}
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_file",
+		Reason:         prompt,
+		Mode:           mode,
+		Filters:        filters,
+		fallbackReason: fallback,
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取用户选择的路径: %s", err.Error())), nil
+	}
+
+	paths := resp.Paths
+	if paths == nil {
+		// 旧版扩展：从文本输入中解析路径
+		for _, line := range strings.Split(resp.UserInput, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				paths = append(paths, line)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return mcp.NewToolResultText("用户没有选择任何路径。"), nil
+	}
+	if mode != "files" && len(paths) > 1 {
+		paths = paths[:1]
+	}
+
+	return mcp.NewToolResultText(formatFileResult(paths)), nil
+}
+
+// formatFileResult 校验路径是否存在并生成结果文本
+func formatFileResult(paths []string) string {
+	var existing, missing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, path)
+		} else {
+			existing = append(existing, path)
+		}
+	}
+
+	var sb strings.Builder
+	if len(existing) > 0 {
+		sb.WriteString("用户选择了以下路径：\n")
+		for _, path := range existing {
+			sb.WriteString(path + "\n")
+		}
+	}
+	if len(missing) > 0 {
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("⚠️ 以下路径不存在：\n")
+		for _, path := range missing {
+			sb.WriteString(path + "\n")
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// ============================================================
+// ask_multiline：粘贴代码、日志等多行长文本
+// 用户输入原样返回，不做任何裁剪，保留换行和缩进
+// ============================================================
+func newAskMultilineTool() mcp.Tool {
+	return mcp.NewTool("ask_multiline",
+		mcp.WithDescription("打开多行编辑器让用户粘贴代码、堆栈信息等长文本，内容原样返回。"),
+		mcp.WithString("prompt",
+			mcp.Required(),
+			mcp.Description("说明需要用户粘贴什么内容"),
+		),
+		mcp.WithString("language",
+			mcp.Description("可选：内容的语言（如 go、python、log），结果会包裹在对应的代码块中"),
+		),
+	)
+}
+
+func askMultilineHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	prompt := argString(request, "prompt")
+	if prompt == "" {
+		return mcp.NewToolResultError("参数 prompt 不能为空"), nil
+	}
+	language := strings.TrimSpace(argString(request, "language"))
+
+	infof("ask_multiline 被调用，提示: %s", prompt)
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_multiline",
+		Reason:         prompt,
+		Multiline:      true,
+		Language:       language,
+		fallbackReason: prompt,
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取用户输入: %s", err.Error())), nil
+	}
+
+	if resp.UserInput == "" {
+		return mcp.NewToolResultText("用户没有输入任何内容。"), nil
+	}
+
+	infof("ask_multiline 收到 %d 字节输入", len(resp.UserInput))
+
+	if language == "" {
+		return mcp.NewToolResultText("用户输入的内容如下：\n\n" + resp.UserInput), nil
+	}
+	return mcp.NewToolResultText("用户输入的内容如下：\n\n" + fenceCode(resp.UserInput, language)), nil
+}
+
+// fenceCode 用代码块包裹文本，围栏长度大于内容中最长的连续反引号
+func fenceCode(content, language string) string {
+	longest, run := 0, 0
+	for _, ch := range content {
+		if ch == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return fence + language + "\n" + content + fence
+}
+
+// ============================================================
+// notify：向用户推送状态消息，不等待回复
+// ============================================================
+func newNotifyTool() mcp.Tool {
+	return mcp.NewTool("notify",
+		mcp.WithDescription("向用户显示一条状态通知（例如“开始迁移，耗时较长”），立即返回，不等待用户回复。"),
+		mcp.WithString("message",
+			mcp.Required(),
+			mcp.Description("要显示给用户的通知内容"),
+		),
+	)
+}
+
+func notifyHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	message := argString(request, "message")
+	if message == "" {
+		return mcp.NewToolResultError("参数 message 不能为空"), nil
+	}
+
+	infof("notify 被调用，内容: %s", message)
+
+	// 不注册 pendingRequests：扩展确认收到即可返回
+	req := ExtensionRequest{
+		Type:      "notify",
+		RequestID: newRequestID(),
+		Reason:    message,
+	}
+	for attempt := 1; attempt <= NotifyRetryCount; attempt++ {
+		if result, _ := tryConnectExtension(req); result.Port > 0 {
+			if result.Details != "" {
+				return mcp.NewToolResultText("通知已显示给用户。扩展提示：" + result.Details), nil
+			}
+			return mcp.NewToolResultText("通知已显示给用户。"), nil
+		}
+		if attempt < NotifyRetryCount {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return mcp.NewToolResultText("通知未能显示：调用已取消。请继续当前任务。"), nil
+			}
+		}
+	}
+
+	warnf("notify 发送失败: %s", req.RequestID)
+	return mcp.NewToolResultText("通知未能显示给用户（扩展未连接或不支持通知）。请继续当前任务。"), nil
+}
+
+// ============================================================
+// report_progress：更新当前任务进度，不弹出新对话框
+// ============================================================
+func newReportProgressTool() mcp.Tool {
+	return mcp.NewTool("report_progress",
+		mcp.WithDescription("在执行耗时任务时向用户报告进度，扩展会更新进度条而不是弹出新的对话框。立即返回。"),
+		mcp.WithNumber("percent",
+			mcp.Required(),
+			mcp.Description("完成百分比（0-100）"),
+			mcp.Min(0),
+			mcp.Max(100),
+		),
+		mcp.WithString("message",
+			mcp.Description("当前进度说明"),
+		),
+	)
+}
+
+func reportProgressHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	percent, ok := argInt(request, "percent")
+	if !ok {
+		return mcp.NewToolResultError("参数 percent 必须是 0-100 的数字"), nil
+	}
+	percent = min(max(percent, 0), 100)
+	message := argString(request, "message")
+
+	// 关联到本会话最近一次的请求，扩展据此更新已有的进度显示
+	requestID := lastSessionRequest(ctx)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	infof("report_progress: %d%% %s (%s)", percent, message, requestID)
+
+	// 只尝试一轮，扩展不可达时静默忽略，不走完整的重试流程
+	result, _ := tryConnectExtension(ExtensionRequest{
+		Type:      "progress",
+		RequestID: requestID,
+		Reason:    message,
+		Percent:   &percent,
+	})
+	if result.Port == 0 {
+		return mcp.NewToolResultText("进度未能显示（扩展未连接），已忽略。请继续当前任务。"), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("进度已更新：%d%%", percent)), nil
+}
+
+// ============================================================
+// set_quick_replies：在等待期间更新快捷回复按钮
+// 旧版扩展忽略 quickReplies 字段，用户仍可手动输入，无需降级
+// ============================================================
+func newSetQuickRepliesTool() mcp.Tool {
+	return mcp.NewTool("set_quick_replies",
+		mcp.WithDescription("更新当前等待中提示框上的快捷回复按钮（如“继续”“运行测试”“查看 diff”）。用户点击按钮即发送对应文本。立即返回。"),
+		mcp.WithArray("quick_replies",
+			mcp.Required(),
+			mcp.Description(fmt.Sprintf("快捷回复列表（最多 %d 个，每个不超过 %d 字），传空数组清除按钮", MaxQuickReplies, MaxQuickReplyLength)),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+	)
+}
+
+func setQuickRepliesHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	quickReplies, err := parseQuickReplies(request)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	requestID := lastSessionRequest(ctx)
+	if requestID == "" {
+		return mcp.NewToolResultText("当前没有等待中的提示，快捷回复可在下次调用 ask_continue 时通过 quick_replies 参数传入。"), nil
+	}
+
+	infof("set_quick_replies: %d 个快捷回复 (%s)", len(quickReplies), requestID)
+
+	// 只尝试一轮，与 report_progress 相同
+	result, _ := tryConnectExtension(ExtensionRequest{
+		Type:         "quick_replies",
+		RequestID:    requestID,
+		QuickReplies: quickReplies,
+	})
+	if result.Port == 0 {
+		return mcp.NewToolResultText("快捷回复未能更新（扩展未连接或不支持），已忽略。"), nil
+	}
+	return mcp.NewToolResultText(fmt.Sprintf("快捷回复已更新：%d 个", len(quickReplies))), nil
+}
+
+// Attachment ask_continue 附带的文件片段，只在提示界面显示，不进入工具结果
+type Attachment struct {
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	Language string `json:"language,omitempty"` // 语法高亮语言
+}
+
+// AttachmentTruncatedMarker 附件被截断时追加的标记
+const AttachmentTruncatedMarker = "\n[truncated]"
+
+// parseAttachments 读取并校验 attachments 参数，合计超出 MaxAttachmentBytes 时按比例截断
+func parseAttachments(request mcp.CallToolRequest) ([]Attachment, error) {
+	var raw []any
+	if request.Params.Arguments != nil {
+		raw, _ = request.Params.Arguments["attachments"].([]any)
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	attachments := make([]Attachment, 0, len(raw))
+	for i, item := range raw {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, argError("itemNotObject", "attachments", i+1)
+		}
+		attachment := Attachment{}
+		attachment.Name, _ = obj["name"].(string)
+		attachment.Content, _ = obj["content"].(string)
+		attachment.Language, _ = obj["language"].(string)
+
+		if attachment.Content == "" {
+			return nil, argError("itemMissing", "attachments", i+1, "content")
+		}
+		attachment.Name = strings.TrimSpace(attachment.Name)
+		if attachment.Name == "" {
+			attachment.Name = fmt.Sprintf("附件 %d", i+1)
+		}
+		attachments = append(attachments, attachment)
+	}
+	return capAttachments(attachments, MaxAttachmentBytes), nil
+}
+
+// capAttachments 合计内容超出 limit 时，按各附件原始大小的比例分配配额并截断
+// 每个被截断的附件末尾追加 AttachmentTruncatedMarker，标记本身也计入配额
+func capAttachments(attachments []Attachment, limit int) []Attachment {
+	total := 0
+	for _, attachment := range attachments {
+		total += len(attachment.Content)
+	}
+	if total <= limit {
+		return attachments
+	}
+
+	budget := max(limit-len(attachments)*len(AttachmentTruncatedMarker), 0)
+	for i := range attachments {
+		content := attachments[i].Content
+		quota := int(int64(len(content)) * int64(budget) / int64(total))
+		// 不截断多字节字符
+		for quota > 0 && !utf8.RuneStart(content[quota]) {
+			quota--
+		}
+		attachments[i].Content = content[:quota] + AttachmentTruncatedMarker
+	}
+	infof("附件合计 %d 字节，超出 %d 字节限制，已按比例截断", total, limit)
+	return attachments
+}
+
+// parseQuickReplies 读取并校验 quick_replies 参数，未传入时返回 nil
+func parseQuickReplies(request mcp.CallToolRequest) ([]string, error) {
+	return parseButtonLabels(request, "quick_replies")
+}
+
+// parseButtonLabels 读取并校验按钮文字数组（quick_replies / options）：
+// 最多 MaxQuickReplies 个，每个不超过 MaxQuickReplyLength 字，未传入时返回 nil
+func parseButtonLabels(request mcp.CallToolRequest, key string) ([]string, error) {
+	labels, err := argStringSlice(request, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(labels) > MaxQuickReplies {
+		return nil, argError("tooMany", key, MaxQuickReplies, len(labels))
+	}
+	for i, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return nil, argError("itemEmpty", key, i+1)
+		}
+		if n := len([]rune(label)); n > MaxQuickReplyLength {
+			return nil, argError("itemTooLong", key, i+1, n, MaxQuickReplyLength)
+		}
+		labels[i] = label
+	}
+	return labels, nil
+}
+
+// ============================================================
+// ask_rating：让用户打分（如 1-5 分的满意度）
+// ============================================================
+func newAskRatingTool() mcp.Tool {
+	return mcp.NewTool("ask_rating",
+		mcp.WithDescription("让用户对结果打分（例如“对这次重构满意吗，1-5 分？”），返回分数和可选的评价。"),
+		mcp.WithString("question",
+			mcp.Required(),
+			mcp.Description("打分的问题"),
+		),
+		mcp.WithNumber("min",
+			mcp.Description("最低分，默认 1"),
+		),
+		mcp.WithNumber("max",
+			mcp.Description("最高分，默认 5"),
+		),
+		mcp.WithArray("labels",
+			mcp.Description("可选：分值说明。2 项表示最低/最高分的含义，或与分值数量相同，逐项对应"),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+	)
+}
+
+func askRatingHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	question := argString(request, "question")
+	if question == "" {
+		return mcp.NewToolResultError("参数 question 不能为空"), nil
+	}
+
+	minScore, ok := argInt(request, "min")
+	if !ok {
+		minScore = 1
+	}
+	maxScore, ok := argInt(request, "max")
+	if !ok {
+		maxScore = 5
+	}
+	if minScore >= maxScore {
+		return mcp.NewToolResultError(fmt.Sprintf("min (%d) 必须小于 max (%d)", minScore, maxScore)), nil
+	}
+
+	labels, err := argStringSlice(request, "labels")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	if n := len(labels); n != 0 && n != 2 && n != maxScore-minScore+1 {
+		return mcp.NewToolResultError(fmt.Sprintf("labels 应为 2 项或 %d 项，实际 %d 项", maxScore-minScore+1, n)), nil
+	}
+
+	infof("ask_rating 被调用，问题: %s，范围: %d-%d", question, minScore, maxScore)
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_rating",
+		Reason:         question,
+		Min:            &minScore,
+		Max:            &maxScore,
+		Labels:         labels,
+		fallbackReason: ratingFallbackReason(question, minScore, maxScore, labels),
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取用户评分: %s", err.Error())), nil
+	}
+
+	return mcp.NewToolResultText(formatRatingResult(resp, minScore, maxScore)), nil
+}
+
+// ratingFallbackReason 生成旧版扩展使用的纯文本提问
+func ratingFallbackReason(question string, minScore, maxScore int, labels []string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s\n\n请输入 %d-%d 之间的整数评分，可在分数后附上评价。", question, minScore, maxScore)
+	switch len(labels) {
+	case 0:
+	case 2:
+		fmt.Fprintf(&sb, "\n%d = %s，%d = %s", minScore, labels[0], maxScore, labels[1])
+	default:
+		for i, label := range labels {
+			fmt.Fprintf(&sb, "\n%d = %s", minScore+i, label)
+		}
+	}
+	return sb.String()
+}
+
+// formatRatingResult 解析评分；旧版扩展只返回文本时，取第一个词作为分数
+func formatRatingResult(resp *CallbackResponse, minScore, maxScore int) string {
+	score := resp.Rating
+	comment := strings.TrimSpace(resp.UserInput)
+
+	if score == nil {
+		fields := strings.Fields(comment)
+		if len(fields) == 0 {
+			return "用户没有给出评分。"
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return fmt.Sprintf("用户的回答不是有效的评分：\n\n%s", resp.UserInput)
+		}
+		score = &n
+		comment = strings.TrimSpace(strings.TrimPrefix(comment, fields[0]))
+	}
+
+	if *score < minScore || *score > maxScore {
+		return fmt.Sprintf("用户给出的评分 %d 超出范围 %d-%d。\n\n原始回答：%s", *score, minScore, maxScore, resp.UserInput)
+	}
+
+	result := fmt.Sprintf("用户评分 %d/%d", *score, maxScore)
+	if comment != "" {
+		result += fmt.Sprintf("\n\n用户评价：\n%s", comment)
+	}
+	return result
+}
+
+// ============================================================
+// ask_form：一次收集多个字段
+// ============================================================
+
+// FormField ask_form 的单个字段定义
+type FormField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label,omitempty"`
+	Type     string `json:"type,omitempty"` // text / number / boolean 等，由扩展决定如何渲染
+	Required bool   `json:"required,omitempty"`
+	Default  string `json:"default,omitempty"`
+}
+
+func newAskFormTool() mcp.Tool {
+	return mcp.NewTool("ask_form",
+		mcp.WithDescription("用一个表单一次性向用户收集多项信息（例如分支名、提交信息、工单号），避免多次往返。"),
+		mcp.WithString("title",
+			mcp.Required(),
+			mcp.Description("表单标题/说明"),
+		),
+		mcp.WithArray("fields",
+			mcp.Required(),
+			mcp.Description("字段列表，每项包含 name、label、type、required、default"),
+			mcp.Items(map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"name":     map[string]any{"type": "string"},
+					"label":    map[string]any{"type": "string"},
+					"type":     map[string]any{"type": "string"},
+					"required": map[string]any{"type": "boolean"},
+					"default":  map[string]any{"type": "string"},
+				},
+				"required": []string{"name"},
+			}),
+		),
+	)
+}
+
+func askFormHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	title := argString(request, "title")
+	if title == "" {
+		return mcp.NewToolResultError("参数 title 不能为空"), nil
+	}
+
+	fields, err := parseFormFields(request)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+
+	infof("ask_form 被调用，标题: %s，字段数: %d", title, len(fields))
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_form",
+		Reason:         title,
+		Fields:         fields,
+		fallbackReason: formFallbackReason(title, fields),
+	})
+	if err != nil {
+		// 取消整个表单与提交了空字段是两种不同的结果
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 表单未提交: %s", err.Error())), nil
+	}
+
+	values := resp.Values
+	if values == nil {
+		values = parseFormText(resp.UserInput, fields)
+	}
+	return mcp.NewToolResultText(formatFormResult(fields, values)), nil
+}
+
+// parseFormFields 解析并校验 fields 参数
+func parseFormFields(request mcp.CallToolRequest) ([]FormField, error) {
+	var raw []any
+	if request.Params.Arguments != nil {
+		raw, _ = request.Params.Arguments["fields"].([]any)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("参数 fields 不能为空")
+	}
+
+	fields := make([]FormField, 0, len(raw))
+	seen := make(map[string]bool)
+	for i, item := range raw {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("fields 的第 %d 项不是对象", i+1)
+		}
+
+		field := FormField{}
+		field.Name, _ = obj["name"].(string)
+		field.Label, _ = obj["label"].(string)
+		field.Type, _ = obj["type"].(string)
+		field.Required, _ = obj["required"].(bool)
+		if def, ok := obj["default"]; ok && def != nil {
+			field.Default = fmt.Sprint(def)
+		}
+
+		field.Name = strings.TrimSpace(field.Name)
+		if field.Name == "" {
+			return nil, fmt.Errorf("fields 的第 %d 项缺少 name", i+1)
+		}
+		if seen[field.Name] {
+			return nil, fmt.Errorf("字段名 %s 重复", field.Name)
+		}
+		seen[field.Name] = true
+		if field.Label == "" {
+			field.Label = field.Name
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// formFallbackReason 生成旧版扩展使用的纯文本提问，用户按“字段名: 值”逐行填写
+func formFallbackReason(title string, fields []FormField) string {
+	var sb strings.Builder
+	sb.WriteString(title)
+	sb.WriteString("\n\n请按“字段名: 值”的格式逐行填写：\n")
+	for _, field := range fields {
+		fmt.Fprintf(&sb, "%s: ", field.Name)
+		var notes []string
+		if field.Label != field.Name {
+			notes = append(notes, field.Label)
+		}
+		if field.Required {
+			notes = append(notes, "必填")
+		}
+		if field.Default != "" {
+			notes = append(notes, "默认 "+field.Default)
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(&sb, "（%s）", strings.Join(notes, "，"))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// parseFormText 从“字段名: 值”格式的文本中解析字段值
+func parseFormText(text string, fields []FormField) map[string]string {
+	known := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		known[field.Name] = true
+	}
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			name, value, ok = strings.Cut(line, "：")
+		}
+		name = strings.TrimSpace(name)
+		if ok && known[name] {
+			values[name] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+// formatFormResult 填充默认值、检查必填字段并生成键值对文本
+func formatFormResult(fields []FormField, values map[string]string) string {
+	var sb strings.Builder
+	var missing []string
+
+	sb.WriteString("用户提交了表单：\n\n")
+	for _, field := range fields {
+		value, ok := values[field.Name]
+		if (!ok || value == "") && field.Default != "" {
+			value = field.Default
+		}
+		if value == "" && field.Required {
+			missing = append(missing, field.Name)
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", field.Name, value)
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintf(&sb, "\n⚠️ 以下必填字段未填写：%s", strings.Join(missing, ", "))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// ============================================================
+// ask_batch：一次发送多个互不相关的问题，收集全部回答
+// ============================================================
+
+// BatchQuestion ask_batch 的单个子问题，ID 由服务器分配
+type BatchQuestion struct {
+	ID       string `json:"id"`
+	Question string `json:"question"`
+}
+
+// BatchAnswer 扩展回传的子问题回答；用户跳过的问题可省略或标记 skipped
+type BatchAnswer struct {
+	ID      string `json:"id"`
+	Answer  string `json:"answer"`
+	Skipped bool   `json:"skipped,omitempty"`
+}
+
+func newAskBatchTool() mcp.Tool {
+	return mcp.NewTool("ask_batch",
+		mcp.WithDescription("把积累的多个独立问题一次性发给用户，收集全部回答，避免多次往返。用户跳过的问题会标记为未回答。"),
+		mcp.WithArray("questions",
+			mcp.Required(),
+			mcp.Description(fmt.Sprintf("问题列表（最多 %d 个）", MaxBatchQuestions)),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+	)
+}
+
+func askBatchHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	texts, err := argStringSlice(request, "questions")
+	if err != nil {
+		return mcp.NewToolResultError(err.Error()), nil
+	}
+	if len(texts) == 0 {
+		return mcp.NewToolResultError("参数 questions 不能为空"), nil
+	}
+	if len(texts) > MaxBatchQuestions {
+		return mcp.NewToolResultError(fmt.Sprintf("问题最多 %d 个，当前 %d 个", MaxBatchQuestions, len(texts))), nil
+	}
+
+	questions := make([]BatchQuestion, len(texts))
+	for i, text := range texts {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return mcp.NewToolResultError(fmt.Sprintf("第 %d 个问题为空", i+1)), nil
+		}
+		questions[i] = BatchQuestion{ID: fmt.Sprintf("q%d", i+1), Question: text}
+	}
+
+	infof("ask_batch 被调用，问题数: %d", len(questions))
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_batch",
+		Reason:         fmt.Sprintf("AI 有 %d 个问题需要你回答", len(questions)),
+		Questions:      questions,
+		fallbackReason: batchFallbackReason(questions),
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取回答: %s", err.Error())), nil
+	}
+
+	answers := resp.Answers
+	if answers == nil {
+		answers = parseBatchText(resp.UserInput, questions)
+	}
+	return mcp.NewToolResultText(formatBatchResult(questions, answers)), nil
+}
+
+// batchFallbackReason 生成旧版扩展使用的纯文本提问，用户按编号逐行回答
+func batchFallbackReason(questions []BatchQuestion) string {
+	var sb strings.Builder
+	sb.WriteString("请按编号逐行回答以下问题（如“1. 回答”），不想回答的可以跳过：\n\n")
+	for i, q := range questions {
+		fmt.Fprintf(&sb, "%d. %s\n", i+1, q.Question)
+	}
+	return sb.String()
+}
+
+// parseBatchText 从“编号. 回答”格式的文本中解析回答，未找到编号的问题视为未回答
+func parseBatchText(text string, questions []BatchQuestion) []BatchAnswer {
+	var answers []BatchAnswer
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		end := strings.IndexFunc(line, func(r rune) bool { return r < '0' || r > '9' })
+		if end <= 0 {
+			continue
+		}
+		index, _ := strconv.Atoi(line[:end])
+		if index < 1 || index > len(questions) {
+			continue
+		}
+		rest := strings.TrimLeft(line[end:], ".、:：) ")
+		answers = append(answers, BatchAnswer{ID: questions[index-1].ID, Answer: strings.TrimSpace(rest)})
+	}
+	return answers
+}
+
+// formatBatchResult 按问题顺序合并回答，缺失、跳过或为空的标记为未回答
+func formatBatchResult(questions []BatchQuestion, answers []BatchAnswer) string {
+	byID := make(map[string]BatchAnswer, len(answers))
+	for _, answer := range answers {
+		byID[answer.ID] = answer
+	}
+
+	var sb strings.Builder
+	unanswered := 0
+	sb.WriteString("用户的回答：\n")
+	for i, q := range questions {
+		fmt.Fprintf(&sb, "\n%d. %s\n", i+1, q.Question)
+		answer, ok := byID[q.ID]
+		if !ok || answer.Skipped || strings.TrimSpace(answer.Answer) == "" {
+			unanswered++
+			sb.WriteString("   → （未回答）\n")
+			continue
+		}
+		fmt.Fprintf(&sb, "   → %s\n", strings.TrimSpace(answer.Answer))
+	}
+
+	if unanswered > 0 {
+		fmt.Fprintf(&sb, "\n⚠️ 有 %d 个问题未回答，请勿自行假设答案。", unanswered)
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// ============================================================
+// ask_diff_approval：展示 diff，由用户批准、拒绝或提出意见
+// ============================================================
+func newAskDiffApprovalTool() mcp.Tool {
+	return mcp.NewTool("ask_diff_approval",
+		mcp.WithDescription("在应用代码变更前把 unified diff 展示给用户审批。结果首行为 DECISION: approved / rejected / comment，只有 approved 时才能应用变更。"),
+		mcp.WithString("summary",
+			mcp.Required(),
+			mcp.Description("变更说明"),
+		),
+		mcp.WithString("diff",
+			mcp.Required(),
+			mcp.Description("unified diff 格式的变更内容"),
+		),
+	)
+}
+
+func askDiffApprovalHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	summary := argString(request, "summary")
+	diff := argString(request, "diff")
+	if summary == "" || diff == "" {
+		return mcp.NewToolResultError("参数 summary 和 diff 不能为空"), nil
+	}
+
+	preview, truncated := truncateDiff(diff, MaxDiffBytes)
+	if truncated {
+		summary += fmt.Sprintf("\n\n（diff 共 %d 字节，超出 %d 字节限制，仅显示前面部分）", len(diff), MaxDiffBytes)
+	}
+
+	infof("ask_diff_approval 被调用，diff %d 字节", len(diff))
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_diff_approval",
+		Reason:         summary,
+		Diff:           preview,
+		fallbackReason: summary + "\n\n" + fenceCode(preview, "diff") + "\n\n请回复“批准”或“拒绝”，也可以直接写下修改意见。",
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("DECISION: rejected\n\n⚠️ 未能获取审批结果: %s\n请视为未批准，不要应用该变更。", err.Error())), nil
+	}
+
+	decision := resp.Decision
+	comment := strings.TrimSpace(resp.UserInput)
+	if decision == "" {
+		decision, comment = parseDecisionText(comment)
+	}
+	return mcp.NewToolResultText(formatDiffDecision(decision, comment)), nil
+}
+
+// truncateDiff 按行截断 diff，保证不超过 limit 字节
+func truncateDiff(diff string, limit int) (string, bool) {
+	if len(diff) <= limit {
+		return diff, false
+	}
+	cut := strings.LastIndex(diff[:limit], "\n")
+	if cut <= 0 {
+		cut = limit
+	}
+	return diff[:cut] + "\n... (truncated)\n", true
+}
+
+// parseDecisionText 解析旧版扩展返回的纯文本审批结果，非批准/拒绝的输入视为意见
+func parseDecisionText(text string) (string, string) {
+	switch strings.ToLower(strings.Trim(text, " 。.!！")) {
+	case "批准", "同意", "approve", "approved", "yes", "y", "ok":
+		return "approved", ""
+	case "拒绝", "不同意", "reject", "rejected", "no", "n":
+		return "rejected", ""
+	}
+	return "comment", text
+}
+
+// formatDiffDecision 生成审批结果，首行固定为 DECISION: <结果>，便于模型区分
+func formatDiffDecision(decision, comment string) string {
+	var text string
+	switch decision {
+	case "approved":
+		text = "DECISION: approved\n\n用户批准了该变更，请应用。"
+	case "rejected":
+		text = "DECISION: rejected\n\n用户拒绝了该变更，不要应用。"
+	default:
+		if comment == "" {
+			return "DECISION: rejected\n\n用户没有给出审批结果，请视为未批准，不要应用该变更。"
+		}
+		return "DECISION: comment\n\n用户未批准，提出了以下意见。请先不要应用，根据意见修改后重新请求审批：\n\n" + comment
+	}
+	if comment != "" {
+		text += "\n\n用户补充：" + comment
+	}
+	return text
+}
+
+// ============================================================
+// ask_command_approval：执行命令前征得用户同意
+// 与 ask_continue 不同，任何失败（连接失败、取消、无法识别的回复）都按拒绝处理
+// ============================================================
+func newAskCommandApprovalTool() mcp.Tool {
+	return mcp.NewTool("ask_command_approval",
+		mcp.WithDescription("在执行可能有破坏性的 shell 命令前征得用户同意。结果首行为 DECISION: approved / denied / modified；modified 时必须执行用户修改后的命令，denied 时不得执行。"),
+		mcp.WithString("command",
+			mcp.Required(),
+			mcp.Description("将要执行的命令"),
+		),
+		mcp.WithString("cwd",
+			mcp.Description("命令的工作目录"),
+		),
+		mcp.WithString("risk",
+			mcp.Description("风险等级"),
+			mcp.Enum("low", "medium", "high"),
+		),
+	)
+}
+
+func askCommandApprovalHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	command := strings.TrimSpace(argString(request, "command"))
+	if command == "" {
+		return mcp.NewToolResultError("参数 command 不能为空"), nil
+	}
+	cwd := argString(request, "cwd")
+	risk := argString(request, "risk")
+	switch risk {
+	case "":
+		risk = "medium"
+	case "low", "medium", "high":
+	default:
+		return mcp.NewToolResultError("参数 risk 必须是 low、medium 或 high"), nil
+	}
+
+	infof("ask_command_approval 被调用，风险: %s", risk)
+
+	reason := fmt.Sprintf("AI 请求执行命令（风险：%s）", risk)
+	if cwd != "" {
+		reason += "\n工作目录：" + cwd
+	}
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:           "ask_command_approval",
+		Reason:         reason,
+		Command:        command,
+		Cwd:            cwd,
+		Risk:           risk,
+		fallbackReason: reason + "\n\n" + fenceCode(command, "sh") + "\n\n回复“允许”执行，“拒绝”取消；要改用其他命令请输入“修改：<新命令>”。",
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("DECISION: denied\n\n⚠️ 未能获得用户同意（%s），不得执行该命令。", err.Error())), nil
+	}
+
+	decision := resp.Decision
+	text := strings.TrimSpace(resp.UserInput)
+	if decision == "" {
+		decision, text = parseCommandDecision(text)
+	}
+	return mcp.NewToolResultText(formatCommandDecision(decision, command, text)), nil
+}
+
+// editedCommandPrefixes 旧版扩展中用户明确给出修改后命令的前缀
+var editedCommandPrefixes = []string{"修改：", "修改:", "modify:", "modified:", "edit:"}
+
+// parseCommandDecision 解析旧版扩展返回的纯文本
+// 只有带“修改：”等明确前缀的输入才视为修改后的命令；其他无法识别的输入按拒绝处理，原文作为用户说明返回
+func parseCommandDecision(text string) (string, string) {
+	switch strings.ToLower(strings.Trim(text, " 。.!！")) {
+	case "":
+		return "denied", ""
+	case "允许", "同意", "批准", "approve", "approved", "allow", "yes", "y":
+		return "approved", ""
+	case "拒绝", "不同意", "deny", "denied", "no", "n":
+		return "denied", ""
+	}
+	for _, prefix := range editedCommandPrefixes {
+		if len(text) >= len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+			return "modified", strings.TrimSpace(text[len(prefix):])
+		}
+	}
+	return "denied", text
+}
+
+// formatCommandDecision 生成审批结果，无法识别的结果一律按拒绝处理
+// modified 时 text 是修改后的命令，denied 时是用户的说明（可能为空）
+func formatCommandDecision(decision, command, text string) string {
+	const denied = "DECISION: denied\n\n用户未同意执行该命令，不得执行。"
+	switch decision {
+	case "approved":
+		return "DECISION: approved\n\n用户同意执行命令：\n\n" + fenceCode(command, "sh")
+	case "modified":
+		if text != "" {
+			return "DECISION: modified\n\n用户修改了命令，只能执行以下命令，不要执行原命令：\n\n" + fenceCode(text, "sh")
+		}
+	case "denied":
+		if text != "" {
+			return denied + "\n\n用户说明：\n" + text
+		}
+	}
+	return denied
+}
+
+// ============================================================
+// schedule_check_in：延迟一段时间后再询问用户（适合等待后台任务）
+// 工具调用在等待期间一直阻塞，MCP 调用取消时计时器随之停止
+// ============================================================
+func newScheduleCheckInTool() mcp.Tool {
+	return mcp.NewTool("schedule_check_in",
+		mcp.WithDescription("在指定的秒数后再询问用户（例如“10 分钟后回来看构建结果”）。调用会一直等待到计时结束并得到用户回复后才返回。"),
+		mcp.WithNumber("delay_seconds",
+			mcp.Required(),
+			mcp.Description(fmt.Sprintf("延迟秒数（1-%d）", int(MaxCheckInDelay.Seconds()))),
+			mcp.Min(1),
+			mcp.Max(MaxCheckInDelay.Seconds()),
+		),
+		mcp.WithString("reason",
+			mcp.Required(),
+			mcp.Description("到时要问用户的内容"),
+		),
+	)
+}
+
+func scheduleCheckInHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	seconds, ok := argInt(request, "delay_seconds")
+	delay := time.Duration(seconds) * time.Second
+	if !ok || delay < time.Second || delay > MaxCheckInDelay {
+		return mcp.NewToolResultError(fmt.Sprintf("参数 delay_seconds 必须在 1 到 %d 之间", int(MaxCheckInDelay.Seconds()))), nil
+	}
+	reason := argString(request, "reason")
+	if reason == "" {
+		return mcp.NewToolResultError("参数 reason 不能为空"), nil
+	}
+
+	infof("schedule_check_in 被调用，%v 后询问用户", delay)
+	scheduledAt := time.Now()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		infof("schedule_check_in 已取消: %v", ctx.Err())
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 定时回访已取消: %v", ctx.Err())), nil
+	}
+
+	resp, err := requestUserInput(ctx, ExtensionRequest{
+		Type:   "ask_continue",
+		Reason: fmt.Sprintf("⏰ 定时回访（%s 安排，延迟 %v）\n\n%s", scheduledAt.Format(time.TimeOnly), delay, reason),
+	})
+	if err != nil {
+		return mcp.NewToolResultText(fmt.Sprintf("⚠️ 未能获取用户回复: %s", err.Error())), nil
+	}
+	if resp.IsEnded() {
+		return mcp.NewToolResultText("用户选择结束对话。"), nil
+	}
+	return mcp.NewToolResultText("定时回访，用户回复：\n\n" + resp.UserInput), nil
+}
+
+// ============================================================
+// extension_status：检查扩展是否可达（单轮探测，不重试、不注册请求）
+// ============================================================
+func newExtensionStatusTool() mcp.Tool {
+	return mcp.NewTool("extension_status",
+		mcp.WithDescription("检查 Windsurf 扩展是否在运行且可达。建议在开始耗时任务前调用，以便尽早发现扩展未启动的问题。"),
+	)
+}
+
+// portStatus 单个扩展端口的探测结果
+type portStatus struct {
+	Port    int
+	Alive   bool
+	Version string
+	Error   string
+}
+
+func extensionStatusHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	ports := discoverExtensionPorts()
+	infof("extension_status 被调用，候选端口: %v", ports)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "回调端口: %d\n", currentCallbackPort)
+	fmt.Fprintf(&sb, "端口文件目录: %s\n\n", portFileDir)
+
+	aliveCount := 0
+	for _, port := range ports {
+		status := probeExtensionPort(ctx, port)
+		if status.Alive {
+			aliveCount++
+			fmt.Fprintf(&sb, "✅ 端口 %d 可达", port)
+			if status.Version != "" {
+				fmt.Fprintf(&sb, "（扩展版本 %s）", status.Version)
+			}
+			sb.WriteString("\n")
+		} else {
+			fmt.Fprintf(&sb, "❌ 端口 %d 不可达: %s\n", port, status.Error)
+		}
+	}
+
+	if aliveCount == 0 {
+		sb.WriteString("\n⚠️ 没有可达的扩展。请确认 Ask Continue 扩展已安装并在 Windsurf 中运行，必要时重新加载窗口。")
+	} else {
+		fmt.Fprintf(&sb, "\n共 %d 个扩展端口可达。", aliveCount)
+	}
+	return mcp.NewToolResultText(sb.String()), nil
+}
+
+// probeExtensionPort 向扩展发送一次 GET /health，任何 HTTP 响应都视为可达
+func probeExtensionPort(ctx context.Context, port int) portStatus {
+	status := portStatus{Port: port}
+
+	ctx, cancel := context.WithTimeout(ctx, StatusProbeTimeout)
+	defer cancel()
+
+	url := extensionURL(port, "/health")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	waitProbeSlot()
+	resp, err := extensionClient.Do(req)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer resp.Body.Close()
+
+	status.Alive = true
+	if resp.StatusCode == http.StatusOK {
+		var info struct {
+			Version string `json:"version"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&info) == nil {
+			status.Version = info.Version
+		}
+	}
+	return status
+}
+
+// ============================================================
+// list_pending：查看服务器仍在等待的请求
+// ============================================================
+func newListPendingTool() mcp.Tool {
+	return mcp.NewTool("list_pending",
+		mcp.WithDescription("列出服务器当前仍在等待用户响应的请求（请求 ID、原因、送达端口、等待时长），用于排查卡住的问题。"),
+	)
+}
+
+func listPendingHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	type row struct {
+		id      string
+		pending PendingRequest
+	}
+
+	pendingMutex.RLock()
+	rows := make([]row, 0, len(pendingRequests))
+	for id, pending := range pendingRequests {
+		rows = append(rows, row{id: id, pending: *pending})
+	}
+	pendingMutex.RUnlock()
+
+	if len(rows) == 0 {
+		return mcp.NewToolResultText("no pending requests（当前没有待处理的请求）"), nil
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].pending.CreatedAt.Before(rows[j].pending.CreatedAt)
+	})
+
+	var sb strings.Builder
+	sb.WriteString("| 请求 ID | 类型 | 端口 | 已等待 | 原因 |\n")
+	sb.WriteString("|---|---|---|---|---|\n")
+	for _, r := range rows {
+		port := "未送达"
+		if r.pending.Port > 0 {
+			port = strconv.Itoa(r.pending.Port)
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %v | %s |\n",
+			r.id,
+			r.pending.Type,
+			port,
+			time.Since(r.pending.CreatedAt).Round(time.Second),
+			truncateRunes(strings.ReplaceAll(r.pending.Reason, "\n", " "), 40),
+		)
+	}
+	return mcp.NewToolResultText(sb.String()), nil
+}
+
+// truncateRunes 按字符截断文本，不会截断多字节字符
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "…"
+}
+
+// ============================================================
+// conversation_stats：本次会话的交互统计
+// ============================================================
+func newConversationStatsTool() mcp.Tool {
+	return mcp.NewTool("conversation_stats",
+		mcp.WithDescription("查看本次会话的交互统计：询问次数、平均/总等待时长、取消次数等。"),
+	)
+}
+
+func conversationStatsHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	snap := statsSnapshot()
+
+	cancelRate := 0.0
+	if snap.Asks > 0 {
+		cancelRate = float64(snap.Cancelled) / float64(snap.Asks) * 100
+	}
+
+	return mcp.NewToolResultText(fmt.Sprintf(
+		"会话开始时间: %s\n询问次数: %d\n已回复: %d\n已取消: %d（%.1f%%）\n连接失败: %d\n总等待时长: %v\n平均等待时长: %v%s",
+		snap.StartTime.Format(time.DateTime),
+		snap.Asks,
+		snap.Answered,
+		snap.Cancelled, cancelRate,
+		snap.ConnectFailures,
+		snap.TotalWait.Round(time.Second),
+		snap.AverageWait().Round(time.Second),
+		formatCategoryCounts(snap.ByCategory),
+	)), nil
+}
+
+// formatCategoryCounts 按分类列出询问次数，没有带分类的询问时返回空串
+func formatCategoryCounts(counts map[string]int64) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(askCategories))
+	for _, category := range askCategories {
+		if n := counts[category]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", category, n))
+		}
+	}
+	return "\n按分类: " + strings.Join(parts, "，")
+}
+
+// ============================================================
+// get_last_response：回看最近的问答，避免重复询问已回答过的问题
+// ============================================================
+func newGetLastResponseTool() mcp.Tool {
+	return mcp.NewTool("get_last_response",
+		mcp.WithDescription("查看最近几次向用户提问的问题和用户的回答（最新的在前）。在重复提问前先用它确认用户是否已经回答过。敏感输入不会保留。"),
+		mcp.WithNumber("count",
+			mcp.Description("返回的条数，默认 1"),
+			mcp.Min(1),
+		),
+	)
+}
+
+func getLastResponseHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	count, ok := argInt(request, "count")
+	if !ok || count < 1 {
+		count = 1
+	}
+
+	entries := recentHistory(count)
+	if len(entries) == 0 {
+		return mcp.NewToolResultText("还没有已完成的问答记录。"), nil
+	}
+
+	var sb strings.Builder
+	for i, entry := range entries {
+		if i > 0 {
+			sb.WriteString("\n---\n\n")
+		}
+		kind := entry.Type
+		if entry.Category != "" {
+			kind += "/" + entry.Category
+		}
+		fmt.Fprintf(&sb, "[%s] %s（%s 提问，%s 回复）\n", entry.RequestID, kind,
+			entry.AskedAt.Format(time.DateTime), entry.AnsweredAt.Format(time.DateTime))
+		fmt.Fprintf(&sb, "问题：%s\n", entry.Reason)
+		switch {
+		case entry.Cancelled:
+			sb.WriteString("回答：（用户取消）\n")
+		case entry.UserInput == "":
+			sb.WriteString("回答：（空）\n")
+		default:
+			fmt.Fprintf(&sb, "回答：%s\n", entry.UserInput)
+		}
+	}
+	return mcp.NewToolResultText(strings.TrimRight(sb.String(), "\n")), nil
+}
+
+// ============================================================
+// end_conversation：用户明确要求结束时由 AI 调用
+// ============================================================
+func newEndConversationTool() mcp.Tool {
+	return mcp.NewTool("end_conversation",
+		mcp.WithDescription("仅在用户明确表示要结束对话时调用。通知扩展关闭对话，之后不要再调用 ask_continue。"),
+		mcp.WithString("summary",
+			mcp.Description("可选：本次对话的简要总结"),
+		),
+	)
+}
+
+func endConversationHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	summary := argString(request, "summary")
+	infof("end_conversation 被调用")
+
+	// 通知扩展对话已结束（尽力而为，失败不影响结果）
+	tryConnectExtension(ExtensionRequest{
+		Type:      "end_conversation",
+		RequestID: newRequestID(),
+		Reason:    summary,
+	})
+
+	return mcp.NewToolResultText("对话已结束。请不要再调用 ask_continue。"), nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ============================================================
+// ask_select
+// ============================================================
+
+func TestValidateSelectOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		wantErr string
+	}{
+		{"valid", []string{"方案 A", "方案 B"}, ""},
+		{"empty list", nil, "不能为空"},
+		{"blank option", []string{"方案 A", "  "}, "第 2 个选项为空"},
+		{"duplicate", []string{"方案 A", "方案 B", "方案 A"}, "第 3 个选项与第 1 个重复"},
+		{"too many", slices.Repeat([]string{"x"}, MaxSelectOptions+1), "选项过多"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSelectOptions(tt.options)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateSelectOptions() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateSelectOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormatSelectResult(t *testing.T) {
+	options := []string{"重构", "打补丁"}
+	index := func(i int) *int { return &i }
+	tests := []struct {
+		name        string
+		resp        CallbackResponse
+		allowCustom bool
+		want        string
+	}{
+		{"selected index", CallbackResponse{SelectedIndex: index(1)}, false, "用户选择了选项 2：打补丁"},
+		{"selected with comment", CallbackResponse{SelectedIndex: index(0), UserInput: "先写测试"}, false, "用户选择了选项 1：重构\n\n补充说明：\n先写测试"},
+		{"index out of range", CallbackResponse{SelectedIndex: index(5)}, false, "用户没有选择任何选项。"},
+		{"negative index", CallbackResponse{SelectedIndex: index(-1), UserInput: "都不要"}, true, "用户没有选择预设选项，输入了自定义回答：\n\n都不要"},
+		{"number fallback", CallbackResponse{UserInput: " 2 "}, false, "用户选择了选项 2：打补丁"},
+		{"number out of range", CallbackResponse{UserInput: "3"}, false, "用户的回答不匹配任何选项：\n\n3\n\n请根据用户的回答自行判断。"},
+		{"option text fallback", CallbackResponse{UserInput: "重构"}, false, "用户选择了选项 1：重构"},
+		{"free text allowed", CallbackResponse{UserInput: "先回滚"}, true, "用户没有选择预设选项，输入了自定义回答：\n\n先回滚"},
+		{"free text not allowed", CallbackResponse{UserInput: "先回滚"}, false, "用户的回答不匹配任何选项：\n\n先回滚\n\n请根据用户的回答自行判断。"},
+		{"empty", CallbackResponse{}, true, "用户没有选择任何选项。"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatSelectResult(&tt.resp, options, tt.allowCustom); got != tt.want {
+				t.Errorf("formatSelectResult() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskSelectRoundTrip(t *testing.T) {
+	startTestServer(t)
+	ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		last := len(req.Options) - 1
+		return &CallbackResponse{SelectedIndex: &last}
+	})
+
+	if result := callTool(t, askSelectHandler, map[string]any{"question": "怎么修？", "options": []any{"重构", "重构"}}); !result.IsError {
+		t.Fatalf("重复选项应返回参数错误，得到 %q", resultText(result))
+	}
+
+	text := resultText(callTool(t, askSelectHandler, map[string]any{
+		"question":     "怎么修？",
+		"options":      []any{"重构", "打补丁"},
+		"allow_custom": true,
+	}))
+	sent := ext.next(t)
+	if sent.Type != "ask_select" || !slices.Equal(sent.Options, []string{"重构", "打补丁"}) || !sent.AllowCustom {
+		t.Errorf("扩展收到的请求 = %+v", sent)
+	}
+	if text != "用户选择了选项 2：打补丁" {
+		t.Errorf("结果 = %q", text)
+	}
+}
+
+// ============================================================
+// ask_multiline
+// ============================================================
+
+func TestFenceCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		language string
+		want     string
+	}{
+		{"plain", "x := 1", "go", "```go\nx := 1\n```"},
+		{"keeps trailing newline", "line\n", "", "```\nline\n```"},
+		{"longer fence than content backticks", "use ```go blocks", "md", "````md\nuse ```go blocks\n````"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fenceCode(tt.content, tt.language); got != tt.want {
+				t.Errorf("fenceCode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskMultilineReturnsInputVerbatim(t *testing.T) {
+	startTestServer(t)
+	pasted := "func main() {\n\t// 缩进和空行都要保留\n\n\tfmt.Println(\"```\")\n}\n"
+	ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		return &CallbackResponse{UserInput: pasted}
+	})
+
+	if result := callTool(t, askMultilineHandler, map[string]any{}); !result.IsError {
+		t.Fatal("缺少 prompt 时应返回错误")
+	}
+
+	text := resultText(callTool(t, askMultilineHandler, map[string]any{"prompt": "粘贴代码", "language": "go"}))
+	sent := ext.next(t)
+	if sent.Type != "ask_multiline" || !sent.Multiline || sent.Language != "go" {
+		t.Errorf("扩展收到的请求 = %+v", sent)
+	}
+	if !strings.HasSuffix(text, fenceCode(pasted, "go")) {
+		t.Errorf("结果没有原样包含输入:\n%s", text)
+	}
+}
+
+// ============================================================
+// ask_rating
+// ============================================================
+
+func TestAskRatingRejectsInvalidArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]any
+	}{
+		{"missing question", map[string]any{}},
+		{"min not below max", map[string]any{"question": "q", "min": 5.0, "max": 5.0}},
+		{"labels count mismatch", map[string]any{"question": "q", "labels": []any{"a", "b", "c"}}},
+		{"labels not strings", map[string]any{"question": "q", "labels": []any{1.0, 2.0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := callTool(t, askRatingHandler, tt.args); !result.IsError {
+				t.Errorf("应返回参数错误，得到 %q", resultText(result))
+			}
+		})
+	}
+}
+
+func TestFormatRatingResult(t *testing.T) {
+	four := 4
+	tests := []struct {
+		name string
+		resp CallbackResponse
+		want string
+	}{
+		{"structured rating", CallbackResponse{Rating: &four, UserInput: "不错"}, "用户评分 4/5\n\n用户评价：\n不错"},
+		{"text fallback", CallbackResponse{UserInput: "3 还行"}, "用户评分 3/5\n\n用户评价：\n还行"},
+		{"out of range", CallbackResponse{UserInput: "9"}, "用户给出的评分 9 超出范围 1-5。\n\n原始回答：9"},
+		{"not a number", CallbackResponse{UserInput: "很好"}, "用户的回答不是有效的评分：\n\n很好"},
+		{"empty", CallbackResponse{}, "用户没有给出评分。"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatRatingResult(&tt.resp, 1, 5); got != tt.want {
+				t.Errorf("formatRatingResult() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAskRatingSendsRange(t *testing.T) {
+	startTestServer(t)
+	ext := newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+		score := *req.Max
+		return &CallbackResponse{Rating: &score}
+	})
+
+	text := resultText(callTool(t, askRatingHandler, map[string]any{"question": "满意吗", "min": 0.0, "max": 10.0, "labels": []any{"差", "好"}}))
+	sent := ext.next(t)
+	if *sent.Min != 0 || *sent.Max != 10 || len(sent.Labels) != 2 {
+		t.Errorf("扩展收到的请求 = %+v", sent)
+	}
+	if text != "用户评分 10/10" {
+		t.Errorf("结果 = %q", text)
+	}
+}
+
+// ============================================================
+// ask_command_approval
+// ============================================================
+
+func TestParseCommandDecision(t *testing.T) {
+	tests := []struct {
+		text, decision, rest string
+	}{
+		{"", "denied", ""},
+		{"允许", "approved", ""},
+		{"Yes!", "approved", ""},
+		{"拒绝。", "denied", ""},
+		{"no", "denied", ""},
+		{"修改：rm -rf ./build", "modified", "rm -rf ./build"},
+		{"Edit: git push --dry-run", "modified", "git push --dry-run"},
+		// 无法识别的自由文本绝不能被当作命令执行
+		{"先备份再说", "denied", "先备份再说"},
+		{"rm -rf /", "denied", "rm -rf /"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			decision, rest := parseCommandDecision(tt.text)
+			if decision != tt.decision || rest != tt.rest {
+				t.Errorf("parseCommandDecision(%q) = %q, %q, want %q, %q", tt.text, decision, rest, tt.decision, tt.rest)
+			}
+		})
+	}
+}
+
+func TestFormatCommandDecision(t *testing.T) {
+	tests := []struct {
+		name, decision, text string
+		wantPrefix           string
+		wantContains         string
+	}{
+		{"approved", "approved", "", "DECISION: approved", "make test"},
+		{"modified", "modified", "make lint", "DECISION: modified", "make lint"},
+		{"modified without command", "modified", "", "DECISION: denied", ""},
+		{"denied with comment", "denied", "先备份", "DECISION: denied", "用户说明：\n先备份"},
+		{"unknown decision", "maybe", "make deploy", "DECISION: denied", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatCommandDecision(tt.decision, "make test", tt.text)
+			if !strings.HasPrefix(got, tt.wantPrefix) || !strings.Contains(got, tt.wantContains) {
+				t.Errorf("formatCommandDecision() = %q", got)
+			}
+			if tt.wantPrefix == "DECISION: denied" && strings.Contains(got, "```") {
+				t.Errorf("拒绝的结果中不应出现可执行的命令: %q", got)
+			}
+		})
+	}
+}
+
+func TestAskCommandApprovalFreeTextIsDenied(t *testing.T) {
+	startTestServer(t)
+	tests := []struct {
+		name       string
+		resp       CallbackResponse
+		wantPrefix string
+	}{
+		{"explicit modified field", CallbackResponse{Decision: "modified", UserInput: "ls -la"}, "DECISION: modified"},
+		{"legacy free text", CallbackResponse{UserInput: "ls -la 也许更好"}, "DECISION: denied"},
+		{"legacy prefix", CallbackResponse{UserInput: "修改：ls -la"}, "DECISION: modified"},
+		{"cancelled", CallbackResponse{Cancelled: true}, "DECISION: denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempPortDir(t)
+			override(t, &lastPort, 0)
+			newFakeExtension(t, func(req ExtensionRequest) *CallbackResponse {
+				resp := tt.resp
+				return &resp
+			})
+			text := resultText(callTool(t, askCommandApprovalHandler, map[string]any{"command": "ls"}))
+			if !strings.HasPrefix(text, tt.wantPrefix) {
+				t.Errorf("结果 = %q, want prefix %q", text, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+// ============================================================
+// ask_continue 的 options 按钮
+// ============================================================
+
+func TestAskContinueOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []any
+		want    []string // 发送给扩展的按钮
+		wantErr string
+	}{
+		{"trimmed", []any{" 继续 ", "停止"}, []string{"继续", "停止"}, ""},
+		{"none", nil, nil, ""},
+		{"too many", slices.Repeat([]any{"x"}, MaxQuickReplies+1), nil, "options"},
+		{"empty item", []any{"继续", "  "}, nil, "第 2 项为空"},
+		{"too long", []any{strings.Repeat("长", MaxQuickReplyLength+1)}, nil, "过长"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startTestServer(t)
+			ext := newFakeExtension(t, func(ExtensionRequest) *CallbackResponse {
+				return &CallbackResponse{UserInput: "继续"}
+			})
+			args := map[string]any{"reason": "下一步？"}
+			if tt.options != nil {
+				args["options"] = tt.options
+			}
+
+			result := callTool(t, askContinueHandler, args)
+			if tt.wantErr != "" {
+				if !result.IsError || !strings.Contains(resultText(result), tt.wantErr) {
+					t.Errorf("结果 = %q, want error containing %q", resultText(result), tt.wantErr)
+				}
+				return
+			}
+			if got := ext.next(t).Options; !slices.Equal(got, tt.want) {
+				t.Errorf("Options = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
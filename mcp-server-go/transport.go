@@ -0,0 +1,62 @@
+// ============================================================
+// MCP 传输方式（ASK_CONTINUE_TRANSPORT）
+// stdio：由 Windsurf 启动的子进程（默认）
+// sse：独立运行的 HTTP/SSE 端点，多个客户端可以同时连接同一个服务器
+// 两种方式下扩展回调都走回调服务器（/response），与 MCP 传输无关
+// ============================================================
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const DefaultSSEAddr = "127.0.0.1:23980" // SSE 端点默认监听地址，避开扩展和回调服务器的端口
+
+var (
+	sseServerMutex sync.Mutex
+	sseServer      *server.SSEServer // sse 模式下正在运行的端点，nil 表示未启动
+)
+
+// serveMCP 按 ASK_CONTINUE_TRANSPORT 启动 MCP 服务，阻塞直到客户端断开或服务关闭
+func serveMCP(s *server.MCPServer) error {
+	if mcpTransport != "sse" {
+		return server.ServeStdio(s)
+	}
+
+	sse := server.NewSSEServer(s,
+		server.WithBaseURL("http://"+sseAddr),
+		// 长时间等待用户回复期间保持连接，避免被代理或客户端判定为空闲断开
+		server.WithKeepAliveInterval(30*time.Second),
+	)
+	sseServerMutex.Lock()
+	sseServer = sse
+	sseServerMutex.Unlock()
+
+	infof("MCP SSE 端点: http://%s/sse", sseAddr)
+	if err := sse.Start(sseAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdownMCPTransport 关闭 sse 端点；stdio 模式下无需处理
+func shutdownMCPTransport() {
+	sseServerMutex.Lock()
+	sse := sseServer
+	sseServerMutex.Unlock()
+	if sse == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout*time.Second)
+	defer cancel()
+	if err := sse.Shutdown(ctx); err != nil {
+		warnf("关闭 MCP SSE 端点失败: %v", err)
+	}
+}